@@ -0,0 +1,412 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+// The admin commands change the database the same way the running bot
+// would, so they are safe to use while it is running:
+//
+//	./telegram-world-tree-bot -config config.json ban -for 3d -reason 刷屏 '#12345678'
+//
+// A bot caching the state of users notices the changes within a second.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type adminCommand struct {
+	usage string
+	help  string
+	// Whether the command takes a list of users, otherwise nothing.
+	takes_users bool
+	// Whether the command takes one file, stored in adminCLI.file.
+	takes_file bool
+	// Defines the options of the command, if any.
+	flags func(a *adminCLI, fs *flag.FlagSet)
+	run   func(a *adminCLI, user int64) error
+}
+
+var adminCommands = map[string]adminCommand{
+	"ban": {
+		usage:       "ban [-for DURATION] [-reason TEXT] [-admin ID] USER...",
+		help:        "put users in the banlist and kick them",
+		takes_users: true,
+		flags: func(a *adminCLI, fs *flag.FlagSet) {
+			fs.StringVar(&a.ban_for, "for", "forever", "how long the ban lasts, like 12h or 3d")
+			fs.StringVar(&a.ban_reason, "reason", "", "the reason shown to the user")
+			fs.Int64Var(&a.ban_admin, "admin", 0, "the administrator issuing the ban")
+		},
+		run: (*adminCLI).ban,
+	},
+	"unban": {
+		usage:       "unban USER...",
+		help:        "remove users from the banlist",
+		takes_users: true,
+		run:         (*adminCLI).unban,
+	},
+	"kick": {
+		usage:       "kick USER...",
+		help:        "disconnect users from the World Tree",
+		takes_users: true,
+		run:         (*adminCLI).kick,
+	},
+	"list-bans": {
+		usage: "list-bans",
+		help:  "list the users in the banlist",
+		run:   (*adminCLI).listBans,
+	},
+	"promote-admin": {
+		usage:       "promote-admin USER...",
+		help:        "make users administrators",
+		takes_users: true,
+		run:         (*adminCLI).promoteAdmin,
+	},
+	"demote-admin": {
+		usage:       "demote-admin USER...",
+		help:        "take away administrator rights",
+		takes_users: true,
+		run:         (*adminCLI).demoteAdmin,
+	},
+	"show-user": {
+		usage:       "show-user USER...",
+		help:        "show the state of users",
+		takes_users: true,
+		run:         (*adminCLI).showUser,
+	},
+	"backup": {
+		usage: "backup",
+		help:  "write a snapshot of the SQLite database to the backup directory",
+		run:   (*adminCLI).backup,
+	},
+	"restore": {
+		usage:      "restore FILE",
+		help:       "replace the SQLite database with a snapshot, stop the bot first",
+		takes_file: true,
+		run:        (*adminCLI).restore,
+	},
+}
+
+type adminCLI struct {
+	conf      *Config
+	clock     Clock
+	dbm       Storage
+	out       io.Writer
+	transport Transport
+
+	ban_for    string
+	ban_reason string
+	ban_admin  int64
+
+	file string
+}
+
+// AdminUsage lists the admin commands.
+func AdminUsage(w io.Writer) {
+	names := make([]string, 0, len(adminCommands))
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Admin commands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n    \t%s\n", adminCommands[name].usage, adminCommands[name].help)
+	}
+	fmt.Fprintln(w, "USER is a Telegram chat ID, optionally prefixed with '#'.")
+}
+
+// RunAdminCommand runs one admin command given on the command line.
+func RunAdminCommand(conf *Config, dbm Storage, out io.Writer, args []string) error {
+	cmd, ok := adminCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command: %q", args[0])
+	}
+	a := &adminCLI{
+		conf:  conf,
+		clock: NewRealClock(),
+		dbm:   dbm,
+		out:   out,
+	}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s\n", cmd.usage)
+		fs.PrintDefaults()
+	}
+	if cmd.flags != nil {
+		cmd.flags(a, fs)
+	}
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	args = fs.Args()
+
+	if cmd.takes_file {
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s", cmd.usage)
+		}
+		a.file = args[0]
+		return cmd.run(a, 0)
+	}
+	if !cmd.takes_users {
+		if len(args) != 0 {
+			return fmt.Errorf("usage: %s", cmd.usage)
+		}
+		return cmd.run(a, 0)
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s", cmd.usage)
+	}
+	users := make([]int64, 0, len(args))
+	for _, arg := range args {
+		user, err := strconv.ParseInt(strings.TrimPrefix(arg, "#"), 10, 64)
+		if err != nil || user == 0 {
+			return fmt.Errorf("invalid user: %q", arg)
+		}
+		users = append(users, user)
+	}
+	for _, user := range users {
+		err := cmd.run(a, user)
+		if err != nil {
+			return fmt.Errorf("#%d: %v", user, err)
+		}
+	}
+	return nil
+}
+
+// notifyPartner tells the partner of a kicked user the chat has ended,
+// like the bot does when someone types /leave.
+func (a *adminCLI) notifyPartner(partner int64) error {
+	if partner == 0 {
+		return nil
+	}
+	if a.transport == nil {
+		transport, err := NewTelegramTransport(a.conf)
+		if err != nil {
+			return err
+		}
+		a.transport = transport
+	}
+	_, err := a.transport.Send(partnerLeftMessage(partner))
+	if err != nil {
+		return fmt.Errorf("notifying partner #%d: %v", partner, err)
+	}
+	fmt.Fprintf(a.out, "Notified partner #%d\n", partner)
+	return nil
+}
+
+// changedUsers tells a running bot with the cache turned on
+// to read the users again.
+func (a *adminCLI) changedUsers() error {
+	versioner, ok := a.dbm.(StateVersioner)
+	if !ok {
+		return nil
+	}
+	return versioner.BumpStateVersion()
+}
+
+func (a *adminCLI) ban(user int64) error {
+	duration, err := ParseBanDuration(a.ban_for)
+	if err != nil {
+		return err
+	}
+	ban := Ban{
+		User:      user,
+		Reason:    a.ban_reason,
+		Admin:     a.ban_admin,
+		CreatedAt: a.clock.Now(),
+	}
+	if duration != 0 {
+		ban.ExpiresAt = ban.CreatedAt.Add(duration)
+	}
+	partner, err := a.dbm.BanUser(ban)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Banned %s\n", describeBan(&ban))
+	err = a.changedUsers()
+	if err != nil {
+		return err
+	}
+	return a.notifyPartner(partner)
+}
+
+func describeBan(ban *Ban) string {
+	text := fmt.Sprintf("#%d", ban.User)
+	if ban.Permanent() {
+		text += " forever"
+	} else {
+		text += " until " + ban.ExpiresAt.Format(time.RFC3339)
+	}
+	if ban.Admin != 0 {
+		text += fmt.Sprintf(" by #%d", ban.Admin)
+	}
+	if ban.Reason != "" {
+		text += fmt.Sprintf(": %s", ban.Reason)
+	}
+	return text
+}
+
+func (a *adminCLI) unban(user int64) error {
+	err := a.dbm.RemoveFromBanList(user)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Unbanned #%d\n", user)
+	return a.changedUsers()
+}
+
+func (a *adminCLI) kick(user int64) error {
+	partner, err := a.dbm.KickUser(user)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Kicked #%d\n", user)
+	err = a.changedUsers()
+	if err != nil {
+		return err
+	}
+	return a.notifyPartner(partner)
+}
+
+func (a *adminCLI) listBans(int64) error {
+	bans, err := a.dbm.ListBans(a.clock.Now())
+	if err != nil {
+		return err
+	}
+	for i := range bans {
+		fmt.Fprintln(a.out, describeBan(&bans[i]))
+	}
+	return nil
+}
+
+func (a *adminCLI) promoteAdmin(user int64) error {
+	err := a.dbm.AddAdmin(user)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Promoted #%d to administrator\n", user)
+	return nil
+}
+
+func (a *adminCLI) demoteAdmin(user int64) error {
+	err := a.dbm.RemoveAdmin(user)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Demoted #%d from administrator\n", user)
+	return nil
+}
+
+func (a *adminCLI) showUser(user int64) error {
+	status, err := a.dbm.GetUser(user)
+	if err != nil {
+		return err
+	}
+	admin, err := a.dbm.IsUserAnAdmin(user)
+	if err != nil {
+		return err
+	}
+	ban, err := a.dbm.GetBan(user, a.clock.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "#%d\n", user)
+	fmt.Fprintf(a.out, "  state:   %v\n", status.State)
+	switch {
+	case status.State.InLobby():
+		fmt.Fprintf(a.out, "  room:    %d\n", status.Room)
+		if status.State == USER_WAITING {
+			fmt.Fprintf(a.out, "  topic:   %s\n", status.Topic)
+		}
+	case status.State == USER_CHATTING:
+		if status.Partner != 0 {
+			fmt.Fprintf(a.out, "  partner: #%d\n", status.Partner)
+		} else {
+			fmt.Fprintln(a.out, "  partner: (left)")
+		}
+	}
+	activity, err := a.dbm.GetUserActivity(user)
+	if err != nil {
+		return err
+	}
+	if !activity.FirstSeen.IsZero() {
+		fmt.Fprintf(a.out, "  since:   %s\n", activity.FirstSeen.Format(time.RFC3339))
+	}
+	if !activity.LastActive.IsZero() {
+		fmt.Fprintf(a.out, "  active:  %s\n", activity.LastActive.Format(time.RFC3339))
+	}
+	fmt.Fprintf(a.out, "  admin:   %v\n", admin)
+	if ban != nil {
+		fmt.Fprintf(a.out, "  banned:  %s\n", describeBan(ban))
+	} else {
+		fmt.Fprintln(a.out, "  banned:  false")
+	}
+	return nil
+}
+
+func (a *adminCLI) backup(int64) error {
+	path, err := RunBackup(a.dbm, a.conf.Backup, a.clock.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Backed up to %s\n", path)
+	return nil
+}
+
+func (a *adminCLI) restore(int64) error {
+	restorer, ok := a.dbm.(Backuper)
+	if !ok {
+		return ErrBackupUnsupported
+	}
+	err := checkSnapshot(a.file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", a.file, err)
+	}
+	// Keep what is being replaced, in case the wrong file was given.
+	// Rotate only afterwards, the file may be among the old snapshots.
+	path, err := backupPath(a.conf.Backup, a.clock.Now())
+	if err != nil {
+		return err
+	}
+	err = restorer.Backup(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Backed up to %s\n", path)
+	err = restorer.Restore(a.file)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Restored from %s\n", a.file)
+	// The snapshot may be older than this program.
+	err = a.dbm.CreateTables()
+	if err != nil {
+		return err
+	}
+	err = a.changedUsers()
+	if err != nil {
+		return err
+	}
+	return rotateBackups(a.conf.Backup)
+}
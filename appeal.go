@@ -0,0 +1,244 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+type AppealState int
+
+// The values are stored in the database, do not renumber.
+// An approved appeal lifts the ban, so it has no state.
+const (
+	APPEAL_NONE AppealState = 0
+	// The next message will be the statement.
+	APPEAL_TYPING   AppealState = 1
+	APPEAL_PENDING  AppealState = 2
+	APPEAL_REJECTED AppealState = 3
+)
+
+const APPEAL_MAX_LENGTH = 200
+
+// Callback data of the buttons sent to administrators:
+// appeal:approve:USER:CREATED_AT or appeal:reject:USER:CREATED_AT
+const APPEAL_CALLBACK_PREFIX = "appeal:"
+
+// handleBanned answers everything a banned user sends.
+// Only /appeal and the statement that follows it do anything.
+func (bot *Bot) handleBanned(msg *tgbotapi.Message, ban *Ban) {
+	if msg.Command() == "appeal" {
+		bot.handleAppeal(msg, ban, strings.TrimSpace(msg.CommandArguments()))
+		return
+	}
+	if ban.Appeal == APPEAL_TYPING && msg.Command() == "" {
+		if msg.Text == "" {
+			bot.askReply(
+				"「世界树」\n"+
+					"\n"+
+					"请用文字说明你的申诉理由：",
+				msg)
+			return
+		}
+		bot.submitAppeal(msg, ban, strings.TrimSpace(msg.Text))
+		return
+	}
+
+	text := bot.banNotice(ban)
+	switch ban.Appeal {
+	case APPEAL_NONE, APPEAL_TYPING:
+		text += "\n如有异议，请戳 /appeal 申诉。"
+	case APPEAL_PENDING:
+		text += "\n你的申诉正在等待管理员处理。"
+	}
+	bot.quickReply(text, msg)
+}
+
+func (bot *Bot) handleAppeal(msg *tgbotapi.Message, ban *Ban, statement string) {
+	switch ban.Appeal {
+	case APPEAL_PENDING:
+		bot.quickReply(
+			"「世界树」\n"+
+				"\n"+
+				"你的申诉正在等待管理员处理。",
+			msg)
+		return
+	case APPEAL_REJECTED:
+		bot.quickReply(
+			"「世界树」\n"+
+				"\n"+
+				"你的申诉未通过，此次拉黑期间不能再次申诉。",
+			msg)
+		return
+	}
+
+	if statement != "" {
+		bot.submitAppeal(msg, ban, statement)
+		return
+	}
+	if ban.Appeal == APPEAL_NONE {
+		err := bot.dbm.SetAppeal(ban.User, ban.CreatedAt, APPEAL_NONE, APPEAL_TYPING, "")
+		if err != nil {
+			bot.replyError(err, msg, true)
+		}
+	}
+	bot.askReply(fmt.Sprintf(
+		"「世界树」\n"+
+			"\n"+
+			"每次拉黑只能申诉一次。\n"+
+			"请用一句话说明你的申诉理由（不超过 %d 字）：",
+		APPEAL_MAX_LENGTH), msg)
+}
+
+func (bot *Bot) submitAppeal(msg *tgbotapi.Message, ban *Ban, statement string) {
+	if utf8.RuneCountInString(statement) > APPEAL_MAX_LENGTH {
+		bot.askReply(fmt.Sprintf(
+			"「世界树」\n"+
+				"\n"+
+				"申诉理由太长了，请控制在 %d 字以内：",
+			APPEAL_MAX_LENGTH), msg)
+		return
+	}
+
+	err := bot.dbm.SetAppeal(ban.User, ban.CreatedAt, ban.Appeal, APPEAL_PENDING, statement)
+	if err == ErrStateChanged {
+		// Sent twice in a row, the first one got there.
+		return
+	} else if err != nil {
+		bot.replyError(err, msg, true)
+	}
+	bot.printLog(msg.From, "(appeal) "+statement, false)
+
+	bot.quickReply(
+		"「世界树」\n"+
+			"\n"+
+			"你的申诉已提交，请等待管理员处理。",
+		msg)
+
+	admins, err := bot.dbm.ListAdmins()
+	if err != nil {
+		bot.replyError(err, msg, false)
+		return
+	}
+	if len(admins) == 0 {
+		log.Printf("No administrator to review the appeal of #%d\n", ban.User)
+		return
+	}
+
+	text := fmt.Sprintf(
+		"【拉黑申诉】\n"+
+			"\n"+
+			"用户：#%d\n", ban.User)
+	if ban.Reason != "" {
+		text += "原因：" + ban.Reason + "\n"
+	}
+	if ban.Permanent() {
+		text += "期限：永久\n"
+	} else {
+		text += "期限：至" + bot.config.Schedule.FormatTime(ban.ExpiresAt) + "\n"
+	}
+	text += "\n" +
+		"申诉：" + statement
+	approve := fmt.Sprintf("%sapprove:%d:%d", APPEAL_CALLBACK_PREFIX, ban.User, unixOrZero(ban.CreatedAt))
+	reject := fmt.Sprintf("%sreject:%d:%d", APPEAL_CALLBACK_PREFIX, ban.User, unixOrZero(ban.CreatedAt))
+	reply_markup := tgbotapi.NewInlineKeyboardMarkup(
+		[]tgbotapi.InlineKeyboardButton{
+			{
+				Text:         "\u2705 解除拉黑",
+				CallbackData: &approve,
+			},
+			{
+				Text:         "\u274c 驳回",
+				CallbackData: &reject,
+			},
+		})
+	replies := make([]tgbotapi.Chattable, 0, len(admins))
+	for _, admin := range admins {
+		reply := tgbotapi.NewMessage(admin, text)
+		reply.ReplyMarkup = reply_markup
+		replies = append(replies, reply)
+	}
+	bot.queue.Send(QUEUE_PRIORITY_HIGH, replies, nil)
+}
+
+// handleAppealCallback handles an administrator tapping approve or reject.
+// Anyone else tapping one, or a malformed one, is ignored.
+func (bot *Bot) handleAppealCallback(query *tgbotapi.CallbackQuery) {
+	fields := strings.Split(strings.TrimPrefix(query.Data, APPEAL_CALLBACK_PREFIX), ":")
+	if len(fields) != 3 || (fields[0] != "approve" && fields[0] != "reject") {
+		return
+	}
+	user, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return
+	}
+	created_at, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return
+	}
+	msg := query.Message
+	ok, err := bot.dbm.IsUserAnAdmin(msg.Chat.ID)
+	if err != nil {
+		bot.replyError(err, msg, true)
+	}
+	if !ok {
+		return
+	}
+
+	approve := fields[0] == "approve"
+	bot.printLog(query.From, "(appeal) "+query.Data, false)
+	err = bot.dbm.ResolveAppeal(user, timeOrZero(created_at), approve)
+	if err == ErrStateChanged {
+		bot.transport.AnswerCallbackQuery(tgbotapi.CallbackConfig{
+			CallbackQueryID: query.ID,
+			Text:            "该申诉已经处理过了",
+		})
+		return
+	} else if err != nil {
+		bot.replyError(err, msg, true)
+	}
+
+	var answer, notice string
+	if approve {
+		answer = fmt.Sprintf("已解除 #%d 的拉黑", user)
+		notice = "「世界树」\n" +
+			"\n" +
+			"你的申诉已通过，拉黑已解除。\n" +
+			"戳 /start 重新连接到世界树。"
+	} else {
+		answer = fmt.Sprintf("已驳回 #%d 的申诉", user)
+		notice = "「世界树」\n" +
+			"\n" +
+			"你的申诉未通过，此次拉黑期间不能再次申诉。"
+	}
+	bot.transport.AnswerCallbackQuery(tgbotapi.CallbackConfig{
+		CallbackQueryID: query.ID,
+		Text:            answer,
+	})
+	bot.queue.Send(QUEUE_PRIORITY_HIGH, []tgbotapi.Chattable{
+		tgbotapi.NewMessage(msg.Chat.ID, "「世界树」\n\n"+answer+"。"),
+		tgbotapi.NewMessage(user, notice),
+	}, nil)
+}
@@ -0,0 +1,249 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/mattn/go-sqlite3"
+)
+
+type BackupConfig struct {
+	// Where the snapshots are written.
+	Dir string `json:"dir"`
+	// How many snapshots to keep, the oldest are removed.
+	Keep int `json:"keep"`
+}
+
+const (
+	BACKUP_PREFIX = "worldtree-"
+	BACKUP_SUFFIX = ".db"
+	// Retry after this long if a writer holds the lock.
+	BACKUP_RETRY_DELAY = 10 * time.Millisecond
+)
+
+var ErrBackupUnsupported = errors.New("online backup is only supported with SQLite, use the tools of your database instead")
+
+// Backuper is implemented by the storages that can be snapshotted.
+type Backuper interface {
+	Backup(path string) error
+	Restore(path string) error
+}
+
+func (conf *BackupConfig) Validate() error {
+	if conf.Dir == "" {
+		return errors.New("config: backup dir is not set")
+	}
+	if conf.Keep < 1 {
+		return fmt.Errorf("config: backup keep must be at least 1: %d", conf.Keep)
+	}
+	return nil
+}
+
+// RunBackup writes a snapshot into the backup directory and removes
+// the oldest ones beyond the limit. It returns the path of the snapshot.
+func RunBackup(dbm Storage, conf *BackupConfig, now time.Time) (path string, err error) {
+	backuper, ok := dbm.(Backuper)
+	if !ok {
+		return "", ErrBackupUnsupported
+	}
+	path, err = backupPath(conf, now)
+	if err != nil {
+		return
+	}
+	err = backuper.Backup(path)
+	if err != nil {
+		return
+	}
+	err = rotateBackups(conf)
+	return
+}
+
+func backupPath(conf *BackupConfig, now time.Time) (path string, err error) {
+	err = os.MkdirAll(conf.Dir, 0700)
+	if err != nil {
+		return
+	}
+	path = filepath.Join(conf.Dir, BACKUP_PREFIX+now.Format("20060102-150405.000")+BACKUP_SUFFIX)
+	return
+}
+
+func rotateBackups(conf *BackupConfig) error {
+	entries, err := os.ReadDir(conf.Dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, BACKUP_PREFIX) && strings.HasSuffix(name, BACKUP_SUFFIX) {
+			names = append(names, name)
+		}
+	}
+	// The timestamps sort in order.
+	sort.Strings(names)
+	for len(names) > conf.Keep {
+		err = os.Remove(filepath.Join(conf.Dir, names[0]))
+		if err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// Backup copies the database to path with SQLite's online backup API,
+// so the bot can keep running. The file appears only when complete.
+func (dbm *dbManager) Backup(path string) error {
+	if dbm.dialect != sqliteDialect {
+		return ErrBackupUnsupported
+	}
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	err := dbm.copySQLite(tmp, true)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Restore replaces the whole database with the snapshot at path.
+// The snapshot must not be newer than this program.
+// Stop the bot first, it does not expect the state to change under it.
+func (dbm *dbManager) Restore(path string) error {
+	if dbm.dialect != sqliteDialect {
+		return ErrBackupUnsupported
+	}
+	err := checkSnapshot(path)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return dbm.copySQLite(path, false)
+}
+
+// checkSnapshot makes sure the file is an intact database we can migrate.
+func checkSnapshot(path string) error {
+	_, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open(sqliteDialect.driver, "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	err = db.QueryRow("PRAGMA integrity_check").Scan(&result)
+	if err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+
+	snapshot := &dbManager{
+		db:      db,
+		dialect: sqliteDialect,
+	}
+	_, err = snapshot.PendingMigrations()
+	return err
+}
+
+// copySQLite copies the database to the file, or the file to the database.
+func (dbm *dbManager) copySQLite(file string, to_file bool) error {
+	ctx := context.Background()
+	conn, err := dbm.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	file_conn, err := (&sqlite3.SQLiteDriver{}).Open(file)
+	if err != nil {
+		return err
+	}
+	defer file_conn.Close()
+
+	return conn.Raw(func(driver_conn interface{}) error {
+		src, dst := driver_conn.(*sqlite3.SQLiteConn), file_conn.(*sqlite3.SQLiteConn)
+		if !to_file {
+			src, dst = dst, src
+		}
+		backup, err := dst.Backup("main", src, "main")
+		if err != nil {
+			return err
+		}
+		for {
+			// Copy everything in one step, so the snapshot is consistent.
+			done, err := backup.Step(-1)
+			if err != nil {
+				backup.Finish()
+				return err
+			}
+			if done {
+				break
+			}
+			time.Sleep(BACKUP_RETRY_DELAY)
+		}
+		return backup.Finish()
+	})
+}
+
+func (bot *Bot) handleBackup(msg *tgbotapi.Message) {
+	user_a := msg.Chat.ID
+	bot.queryUser(msg, true)
+
+	ok, err := bot.dbm.IsUserAnAdmin(user_a)
+	if err != nil {
+		bot.replyError(err, msg, true)
+	}
+	if !ok {
+		bot.handleInvalid(msg)
+		return
+	}
+
+	path, err := RunBackup(bot.dbm, bot.config.Backup, bot.clock.Now())
+	if errors.Is(err, ErrBackupUnsupported) {
+		bot.quickReply(
+			"「世界树」\n"+
+				"\n"+
+				"只有 SQLite 数据库可以在线备份，请用数据库自带的工具备份。",
+			msg)
+		return
+	} else if err != nil {
+		bot.replyError(err, msg, false)
+		return
+	}
+	bot.quickReply(
+		"「世界树」\n"+
+			"\n"+
+			"数据库已备份到："+path,
+		msg)
+}
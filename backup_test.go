@@ -0,0 +1,50 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+// /backup tells the admin when the storage cannot be backed up online.
+func TestHandleBackup(t *testing.T) {
+	replies := map[string]string{
+		STORAGE_MEMORY:   "只有 SQLite 数据库可以在线备份",
+		STORAGE_SQLITE:   "数据库已备份到",
+		STORAGE_POSTGRES: "只有 SQLite 数据库可以在线备份",
+	}
+	for _, storage := range scenarioStorages() {
+		t.Run(storage, func(t *testing.T) {
+			h := newTestHarness(t, storage)
+
+			for _, line := range []string{
+				"user alice 1001",
+				"admin alice",
+				"alice says /backup",
+				"alice receives " + replies[storage],
+				"alice receives nothing",
+			} {
+				err := h.Step(line)
+				if err != nil {
+					t.Fatalf("%s: %v", line, err)
+				}
+			}
+		})
+	}
+}
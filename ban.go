@@ -0,0 +1,100 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ban is one row in the banlist.
+type Ban struct {
+	User   int64
+	Reason string
+	// The administrator who issued it, 0 if it came from the command line.
+	Admin     int64
+	CreatedAt time.Time
+	// Zero if the ban never ends.
+	ExpiresAt  time.Time
+	Appeal     AppealState
+	AppealText string
+}
+
+func (ban *Ban) Permanent() bool {
+	return ban.ExpiresAt.IsZero()
+}
+
+// ExpiredAt reports whether the ban has been lifted by time t.
+func (ban *Ban) ExpiredAt(t time.Time) bool {
+	return !ban.Permanent() && !t.Before(ban.ExpiresAt)
+}
+
+// Bans are stored with Unix seconds, 0 meaning never.
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeOrZero(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// ParseBanDuration accepts Go durations like "12h", whole days like "3d",
+// and "forever" or "" for a ban that never ends, which returns 0.
+func ParseBanDuration(s string) (time.Duration, error) {
+	if s == "" || s == "forever" {
+		return 0, nil
+	}
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid ban duration: %q", s)
+	}
+	return d, nil
+}
+
+// banNotice is the reply to everything a banned user sends.
+func (bot *Bot) banNotice(ban *Ban) string {
+	text := "「世界树」\n" +
+		"\n" +
+		"你已被管理员拉黑。\n"
+	if ban.Reason != "" {
+		text += "原因：" + ban.Reason + "\n"
+	}
+	if ban.Permanent() {
+		text += "此次拉黑没有期限。"
+	} else {
+		text += "将于" + bot.config.Schedule.FormatTime(ban.ExpiresAt) + " 解除。"
+	}
+	return text
+}
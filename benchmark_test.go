@@ -0,0 +1,122 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+// The benchmarks measure what the storage costs the bot per update:
+//
+//	go test -run '^$' -bench .
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// How many users are in the database while benchmarking.
+const BENCHMARK_USERS = 1000
+
+// Update IDs must not repeat, as each benchmark runs several times.
+var benchmark_update_id atomic.Int64
+
+// A chat message passed to the partner.
+func BenchmarkMessage(b *testing.B) {
+	benchmarkStorages(b, func(b *testing.B, dbm Storage) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				id := benchmark_update_id.Add(1)
+				user := id%BENCHMARK_USERS + 1
+				benchmarkMessage(b, dbm, int(id), user)
+			}
+		})
+	})
+}
+
+// Listing the recipients of /wall.
+func BenchmarkBroadcast(b *testing.B) {
+	benchmarkStorages(b, func(b *testing.B, dbm Storage) {
+		for i := 0; i < b.N; i++ {
+			users, err := dbm.ListAllUsers()
+			if err != nil || len(users) != BENCHMARK_USERS {
+				b.Fatal(len(users), err)
+			}
+		}
+	})
+}
+
+func benchmarkMessage(b *testing.B, dbm Storage, update_id int, user int64) {
+	handled, err := dbm.MarkUpdateReceived(update_id)
+	if err != nil || handled {
+		b.Fatal(handled, err)
+	}
+	ban, err := dbm.GetBan(user, time.Now())
+	if err != nil || ban != nil {
+		b.Fatal(ban, err)
+	}
+	status, err := dbm.GetUser(user)
+	if err != nil || status.State != USER_CHATTING {
+		b.Fatal(status, err)
+	}
+	err = dbm.MarkUpdateProcessed(update_id)
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+// benchmarkStorages runs the benchmark on each storage scenarios run on,
+// and again through the cache where it can be turned on.
+func benchmarkStorages(b *testing.B, run func(b *testing.B, dbm Storage)) {
+	for _, storage := range scenarioStorages() {
+		b.Run(storage, func(b *testing.B) {
+			h := newBenchmarkHarness(b, storage)
+			b.ReportAllocs()
+			b.ResetTimer()
+			run(b, h.storage)
+		})
+		if storage != STORAGE_SQLITE {
+			continue
+		}
+		b.Run(storage+"+cache", func(b *testing.B) {
+			h := newBenchmarkHarness(b, storage)
+			cache := NewStateCache(h.storage, h.clock)
+			b.ReportAllocs()
+			b.ResetTimer()
+			run(b, cache)
+		})
+	}
+}
+
+func newBenchmarkHarness(b *testing.B, storage string) *harness {
+	h := newTestHarness(b, storage)
+
+	// Everyone is chatting in pairs: 1 and 2, 3 and 4, ...
+	for user := int64(1); user <= BENCHMARK_USERS; user++ {
+		err := h.storage.TransitionUser(user, USER_DISCONNECTED, UserStatus{State: USER_LOBBY})
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = h.storage.TransitionUser(user, USER_LOBBY, UserStatus{
+			State:   USER_CHATTING,
+			Partner: (user - 1) ^ 1 + 1,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return h
+}
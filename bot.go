@@ -19,34 +19,67 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
 	"log"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
 type Bot struct {
-	api     *tgbotapi.BotAPI
-	dbm     *dbManager
-	queue   *sendQueue
-	updates <-chan tgbotapi.Update
+	config    *Config
+	clock     Clock
+	transport Transport
+	dbm       Storage
+	queue     *sendQueue
+	pool      *updatePool
+	updates   <-chan tgbotapi.Update
+	stop      chan struct{}
+	stopped   chan struct{}
+
+	// Update IDs received in this run and not handled yet.
+	handling_lock sync.Mutex
+	handling      map[int]struct{}
 }
 
-func NewBot(api *tgbotapi.BotAPI, dbm *dbManager) (bot *Bot, err error) {
+func NewBot(conf *Config, clock Clock, transport Transport, dbm Storage) (bot *Bot, err error) {
+	var outbox Outbox
+	if conf.Outbox {
+		var ok bool
+		outbox, ok = dbm.(Outbox)
+		if !ok {
+			return nil, fmt.Errorf("the %s storage cannot keep an outbox", conf.Storage)
+		}
+	}
+	if conf.Cache && conf.Storage != STORAGE_MEMORY {
+		dbm = NewStateCache(dbm, clock)
+	}
 	bot = &Bot{
-		api:   api,
-		dbm:   dbm,
-		queue: NewSendQueue(api, dbm),
+		config:    conf,
+		clock:     clock,
+		transport: transport,
+		dbm:       dbm,
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		handling:  make(map[int]struct{}),
+	}
+	bot.queue, err = NewSendQueue(clock, transport, dbm, outbox, conf.RateLimit)
+	if err != nil {
+		return
 	}
+	bot.pool = NewUpdatePool(clock, conf.Workers, bot.handleReceivedUpdate)
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-	bot.updates, err = api.GetUpdatesChan(u)
+	offset, err := dbm.GetUpdateOffset()
+	if err != nil {
+		return
+	}
+	bot.updates, err = transport.GetUpdates(offset)
 	if err != nil {
 		return
 	}
@@ -54,10 +87,108 @@ func NewBot(api *tgbotapi.BotAPI, dbm *dbManager) (bot *Bot, err error) {
 	return
 }
 
+// ResetCache makes the bot read the users from the storage again,
+// after they have been changed by someone else.
+func (bot *Bot) ResetCache() {
+	cache, ok := bot.dbm.(*stateCache)
+	if !ok {
+		return
+	}
+	cache.Reset()
+	log.Println("Dropped the cached state of users.")
+}
+
 func (bot *Bot) Run() {
-	for update := range bot.updates {
-		bot.processUpdate(&update)
+	defer close(bot.stopped)
+	defer bot.pool.Close()
+	go bot.pool.LogStats(UPDATE_STATS_INTERVAL, bot.stop)
+	if bot.config.IdleTimeout != 0 {
+		go bot.SweepIdleUsers(IDLE_SWEEP_INTERVAL, bot.stop)
+	}
+	for {
+		select {
+		case update := <-bot.updates:
+			bot.receiveUpdate(&update)
+		case <-bot.stop:
+			// Finish what has already been received.
+			for {
+				select {
+				case update := <-bot.updates:
+					bot.receiveUpdate(&update)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown stops receiving updates, waits for Run to return
+// and the updates received to be handled,
+// then drains the send queue until the deadline.
+func (bot *Bot) Shutdown(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	err := bot.transport.StopUpdates(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("Error: %+v\n", err)
+	}
+	log.Println("Stopped receiving updates.")
+
+	close(bot.stop)
+	select {
+	case <-bot.stopped:
+	case <-time.After(time.Until(deadline)):
+		log.Println("Timed out waiting for the current updates to finish.")
+	}
+
+	dropped := bot.queue.Shutdown(deadline)
+	if dropped != 0 {
+		log.Printf("Dropped %d unsent messages.\n", dropped)
+	} else {
+		log.Println("Send queue drained.")
+	}
+}
+
+// receiveUpdate drops updates already handled before a restart,
+// or delivered twice by a webhook retry.
+//
+// An update is only marked as handled once it has been, and the next run
+// asks Telegram again for the first update that was not, so an update
+// still queued when the bot stops is not lost.
+func (bot *Bot) receiveUpdate(update *tgbotapi.Update) {
+	bot.handling_lock.Lock()
+	_, duplicate := bot.handling[update.UpdateID]
+	bot.handling_lock.Unlock()
+	if !duplicate {
+		handled, err := bot.dbm.MarkUpdateReceived(update.UpdateID)
+		if err != nil {
+			log.Printf("Error: %+v\n", err)
+			return
+		}
+		duplicate = handled
+	}
+	if duplicate {
+		log.Printf("Skipping duplicate update #%d\n", update.UpdateID)
+		return
+	}
+	bot.handling_lock.Lock()
+	bot.handling[update.UpdateID] = struct{}{}
+	bot.handling_lock.Unlock()
+	bot.pool.Submit(update)
+}
+
+func (bot *Bot) handleReceivedUpdate(update *tgbotapi.Update) {
+	bot.processUpdate(update)
+	err := bot.dbm.MarkUpdateProcessed(update.UpdateID)
+	if err != nil {
+		log.Printf("Error: %+v\n", err)
 	}
+	bot.handling_lock.Lock()
+	delete(bot.handling, update.UpdateID)
+	bot.handling_lock.Unlock()
 }
 
 func (bot *Bot) processUpdate(update *tgbotapi.Update) {
@@ -70,18 +201,19 @@ func (bot *Bot) processUpdate(update *tgbotapi.Update) {
 
 	msg := update.Message
 	if msg != nil && msg.Chat.IsPrivate() {
+		bot.recordActivity(msg.Chat.ID)
 
-		ok, err := bot.dbm.IsUserInBanList(msg.Chat.ID)
+		ban, err := bot.dbm.GetBan(msg.Chat.ID, bot.clock.Now())
 		if err != nil {
 			bot.replyError(err, msg, true)
 		}
-		if ok {
-			bot.quickReply(`你已被拉黑`, msg)
+		if ban != nil {
+			bot.handleBanned(msg, ban)
 			return
 		}
 
 		if strings.HasPrefix(msg.Text, "/") {
-			printLog(msg.From, msg.Text, false)
+			bot.printLog(msg.From, msg.Text, false)
 		}
 
 		cmd := msg.Command()
@@ -101,6 +233,8 @@ func (bot *Bot) processUpdate(update *tgbotapi.Update) {
 			bot.handleDisconnect(msg)
 		} else if cmd == "wall" {
 			bot.handleWall(msg)
+		} else if cmd == "backup" {
+			bot.handleBackup(msg)
 		} else {
 			bot.handleInvalid(msg)
 		}
@@ -339,6 +473,13 @@ func (bot *Bot) logBroadcastResult(msg_errors []error, msg *tgbotapi.Message) {
 	log.Printf("Sent / failed: %d / %d", success, failure)
 }
 
+// Callback data of the buttons to join a topic: topic:TOPIC
+// Topics have their own prefix, so no topic is taken for another button.
+const TOPIC_CALLBACK_PREFIX = "topic:"
+
+// Telegram takes at most 64 bytes of callback data.
+const MAX_TOPIC_LENGTH = 64 - len(TOPIC_CALLBACK_PREFIX)
+
 func (bot *Bot) sendTopicList(user int64, caption string) (count int, err error) {
 	topics, err := bot.dbm.ListInvites()
 	if err != nil {
@@ -354,10 +495,11 @@ func (bot *Bot) sendTopicList(user int64, caption string) (count int, err error)
 	reply := tgbotapi.NewMessage(user, caption)
 	keyboard := make([][]tgbotapi.InlineKeyboardButton, count)
 	for i := 0; i < count; i++ {
+		data := TOPIC_CALLBACK_PREFIX + topics[i]
 		keyboard[i] = []tgbotapi.InlineKeyboardButton{
 			{
 				Text:         topics[i],
-				CallbackData: &topics[i],
+				CallbackData: &data,
 			},
 		}
 	}
@@ -366,55 +508,45 @@ func (bot *Bot) sendTopicList(user int64, caption string) (count int, err error)
 	return
 }
 
-func (bot *Bot) respondTopic(topic string, short_topic string, user_a int64, user_a_nick string, success_text string, wait_text string, msg *tgbotapi.Message) {
-	user_b, err := bot.dbm.QueryInvitation(short_topic)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if user_b == 0 || user_b == user_a {
+func (bot *Bot) respondTopic(topic string, short_topic string, user_a int64, user_a_status UserStatus, user_a_nick string, success_text string, wait_text string, msg *tgbotapi.Message) {
+	user_b, err := bot.dbm.ClaimInvitation(user_a, short_topic)
+	if err == ErrInvitationTaken {
 		// The topic has gone.
-		if !IsOpenHour(time.Now()) && !DEBUG_MODE {
+		if !bot.config.IsOpenHour(bot.clock.Now()) {
 			bot.quickReply(
 				"「世界树」\n"+
 					"——长夜漫漫，随便找个人，陪你聊到天亮。\n"+
 					"\n"+
-					"\u274c "+CLOSED_MSG,
+					"\u274c "+bot.config.Schedule.ClosedMessage(bot.clock.Now()),
 				msg)
 			return
 		}
 
-		err = bot.dbm.NewInvitation(user_a, short_topic)
-		if err != nil {
+		err = bot.dbm.TransitionUser(user_a, user_a_status.State, UserStatus{State: USER_WAITING, Room: user_a_status.Room, Topic: short_topic})
+		if err == ErrStateChanged {
+			bot.replyStateChanged(msg)
+			return
+		} else if err != nil {
 			bot.replyError(err, msg, true)
 		}
 		bot.quickReply(fmt.Sprintf(wait_text, topic), msg)
-		if user_b == 0 {
-			err = bot.broadcastInvitation(topic, topic, user_a, user_a_nick)
+		// Do not announce the same invitation twice.
+		if user_a_status.State != USER_WAITING || user_a_status.Topic != short_topic {
+			err = bot.broadcastInvitation(topic, short_topic, user_a, user_a_nick)
 			if err != nil {
 				bot.replyError(err, msg, true)
 			}
 		}
 	} else {
-		err = bot.dbm.RemoveInvitationByTopic(topic)
-		if err != nil {
-			bot.replyError(err, msg, true)
-		}
-		err = bot.dbm.LeaveLobby(user_a)
-		if err != nil {
-			bot.replyError(err, msg, true)
-		}
-		err = bot.dbm.LeaveLobby(user_b)
-		if err != nil {
+		if err == ErrStateChanged {
+			bot.replyStateChanged(msg)
+			return
+		} else if err != nil {
 			bot.replyError(err, msg, true)
 		}
 
 		bot.quickReply(fmt.Sprintf(success_text, topic), msg)
 
-		err = bot.dbm.ConnectChat(user_a, user_b)
-		if err != nil {
-			bot.replyError(err, msg, true)
-		}
-
 		text := "「世界树」\n" +
 			"\n" +
 			"\U0001f495 会话已接通，祝你们聊天愉快。\n" +
@@ -422,7 +554,7 @@ func (bot *Bot) respondTopic(topic string, short_topic string, user_a int64, use
 			"话题：" + topic + "\n" +
 			"戳 /leave 离开本次谈话。\n" +
 			"\n"
-		if DEBUG_MODE {
+		if bot.config.Debug {
 			text += "注：当前程序运行在调试模式下，管理员可能会看到聊天记录。请友善待人，不要分享机密信息。"
 		} else {
 			text += "注：接下来的聊天内容不会被记录，管理员无法读取，但请友善待人，不要分享机密信息。"
@@ -444,11 +576,12 @@ func (bot *Bot) broadcastInvitation(topic string, short_topic string, exclude_us
 	if err != nil {
 		return err
 	}
+	data := TOPIC_CALLBACK_PREFIX + short_topic
 	reply_markup := tgbotapi.NewInlineKeyboardMarkup(
 		[]tgbotapi.InlineKeyboardButton{
 			{
 				Text:         "\u2764\ufe0f 加入",
-				CallbackData: &short_topic,
+				CallbackData: &data,
 			},
 		})
 	replies := make([]tgbotapi.Chattable, 0, len(users))
@@ -507,17 +640,37 @@ func (bot *Bot) replyError(err error, msg *tgbotapi.Message, fatal bool) {
 	}
 }
 
+// replyStateChanged answers a message that lost a race with another
+// update, such as the partner leaving at the same time. Nothing is
+// broken, so the user is only asked to try again.
+func (bot *Bot) replyStateChanged(msg *tgbotapi.Message) {
+	log.Printf("User %d changed state while message %d was handled.\n", msg.Chat.ID, msg.MessageID)
+	bot.quickReply(
+		"「世界树」\n"+
+			"\n"+
+			"你的状态刚刚发生了变化，请再试一次。",
+		msg)
+}
+
+// The daily ID rotates at 19:00 UTC, which is 3:00 in Beijing.
+const HASH_ROTATION_OFFSET = 5 * 3600
+
 func (bot *Bot) hashIdentification(chat *tgbotapi.Chat) string {
-	date_seed := (time.Now().Unix() + 5*3600) / 86400
-	hash_sum := sha1.Sum([]byte(fmt.Sprintf("%s %x %x %s %x %s %x", SECRET, chat.ID, len(chat.FirstName), chat.FirstName, len(chat.LastName), chat.LastName, date_seed)))
+	date_seed := (bot.clock.Now().Unix() + HASH_ROTATION_OFFSET) / 86400
+	hash_sum := sha1.Sum([]byte(fmt.Sprintf("%s %x %x %s %x %s %x", bot.config.Secret, chat.ID, len(chat.FirstName), chat.FirstName, len(chat.LastName), chat.LastName, date_seed)))
 	return base64.RawURLEncoding.EncodeToString(hash_sum[:6])
 }
 
+func nextHashRotation(t time.Time) time.Time {
+	date_seed := (t.Unix() + HASH_ROTATION_OFFSET) / 86400
+	return time.Unix((date_seed+1)*86400-HASH_ROTATION_OFFSET, 0)
+}
+
 func (bot *Bot) limitTopic(topic string) string {
-	if len(topic) > 64 {
+	if len(topic) > MAX_TOPIC_LENGTH {
 		last_i := 0
 		for i := range topic {
-			if i > 60 {
+			if i > MAX_TOPIC_LENGTH-len("…") {
 				return topic[:last_i] + "…"
 			}
 			last_i = i
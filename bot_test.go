@@ -0,0 +1,165 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// receiveAll feeds the updates in as if they came from Telegram, and
+// waits until they are handled and the replies sent.
+// The bot takes no more updates afterwards.
+func receiveAll(t *testing.T, h *harness, updates ...*tgbotapi.Update) {
+	t.Helper()
+	for _, update := range updates {
+		h.bot.receiveUpdate(update)
+	}
+	h.bot.pool.Close()
+	err := h.settle()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectReplies(t *testing.T, h *harness, chat *tgbotapi.Chat, texts ...string) {
+	t.Helper()
+	for _, text := range append(texts, "nothing") {
+		err := h.expect(chat, text)
+		if err != nil {
+			t.Fatalf("%s receives %s: %v", chat.FirstName, text, err)
+		}
+	}
+}
+
+// Telegram may deliver an update again, and it is handled only once.
+func TestDuplicateUpdate(t *testing.T) {
+	for _, storage := range scenarioStorages() {
+		t.Run(storage, func(t *testing.T) {
+			h := newTestHarness(t, storage)
+
+			alice := &tgbotapi.Chat{ID: 1001, Type: "private", FirstName: "alice"}
+			update := h.newMessageUpdate(alice, "/start")
+			receiveAll(t, h, update, update, h.newMessageUpdate(alice, "/nick"), update)
+			expectReplies(t, h, alice, "欢迎使用", "你今天在大厅的 ID 是")
+		})
+	}
+}
+
+// Nor is it handled again after a restart, when the bot asks for the
+// updates since the last one it handled.
+func TestDuplicateUpdateAfterRestart(t *testing.T) {
+	alice := &tgbotapi.Chat{ID: 1001, Type: "private", FirstName: "alice"}
+
+	h := newTestHarness(t, STORAGE_SQLITE)
+	update := h.newMessageUpdate(alice, "/start")
+	receiveAll(t, h, update)
+	expectReplies(t, h, alice, "欢迎使用")
+
+	h = restartTestHarness(t, h)
+	receiveAll(t, h, update, h.newMessageUpdate(alice, "/nick"))
+	expectReplies(t, h, alice, "你今天在大厅的 ID 是")
+}
+
+// An update received but not handled before the bot stopped is asked for
+// again, and handled then.
+func TestUnhandledUpdateAfterRestart(t *testing.T) {
+	alice := &tgbotapi.Chat{ID: 1001, Type: "private", FirstName: "alice"}
+
+	h := newTestHarness(t, STORAGE_SQLITE)
+	handled := h.newMessageUpdate(alice, "/start")
+	receiveAll(t, h, handled)
+	expectReplies(t, h, alice, "欢迎使用")
+	// Received, then the bot stopped before handling it.
+	lost := h.newMessageUpdate(alice, "/nick")
+	_, err := h.bot.dbm.MarkUpdateReceived(lost.UpdateID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h = restartTestHarness(t, h)
+	offset, err := h.bot.dbm.GetUpdateOffset()
+	if err != nil || offset != lost.UpdateID {
+		t.Fatalf("offset = %d, %v, expected %d", offset, err, lost.UpdateID)
+	}
+	receiveAll(t, h, handled, lost)
+	expectReplies(t, h, alice, "你今天在大厅的 ID 是")
+	offset, err = h.bot.dbm.GetUpdateOffset()
+	if err != nil || offset != lost.UpdateID+1 {
+		t.Fatalf("offset = %d, %v, expected %d", offset, err, lost.UpdateID+1)
+	}
+}
+
+// staleStorage answers GetUser with what the users looked like before
+// another update changed them.
+type staleStorage struct {
+	Storage
+	stale map[int64]UserStatus
+}
+
+func (s *staleStorage) GetUser(user int64) (UserStatus, error) {
+	if status, ok := s.stale[user]; ok {
+		return status, nil
+	}
+	return s.Storage.GetUser(user)
+}
+
+// An update that loses a race with another one is answered softly.
+func TestStateChangedRace(t *testing.T) {
+	for _, storage := range scenarioStorages() {
+		t.Run(storage, func(t *testing.T) {
+			h := newTestHarness(t, storage)
+			for _, line := range []string{
+				"user alice 1001",
+				"alice says /start",
+				"alice receives 欢迎使用",
+				"alice says /new 聊聊天",
+				"alice receives 你发布了",
+			} {
+				err := h.Step(line)
+				if err != nil {
+					t.Fatalf("%s: %v", line, err)
+				}
+			}
+
+			// /leave reads the invitation, but another update takes it
+			// back before /leave does.
+			waiting, err := h.bot.dbm.GetUser(1001)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = h.bot.dbm.TransitionUser(1001, waiting.State, UserStatus{State: USER_LOBBY, Room: waiting.Room})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.bot.dbm = &staleStorage{Storage: h.bot.dbm, stale: map[int64]UserStatus{1001: waiting}}
+			for _, line := range []string{
+				"alice says /leave",
+				"alice receives 你的状态刚刚发生了变化",
+				"alice receives nothing",
+			} {
+				err := h.Step(line)
+				if err != nil {
+					t.Fatalf("%s: %v", line, err)
+				}
+			}
+		})
+	}
+}
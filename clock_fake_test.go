@@ -0,0 +1,84 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock only moves when told to.
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []fakeClockWaiter
+}
+
+type fakeClockWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func NewFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{
+		now: now,
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeClockWaiter{
+		deadline: c.now.Add(d),
+		ch:       ch,
+	})
+	return ch
+}
+
+// Advance moves the clock forward and fires every timer due by then.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock to t and fires every timer due by then.
+func (c *fakeClock) Set(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = t
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(t) {
+			waiters = append(waiters, w)
+		} else {
+			w.ch <- t
+		}
+	}
+	c.waiters = waiters
+}
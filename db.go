@@ -20,109 +20,330 @@ package main
 
 import (
 	"database/sql"
-
-	_ "github.com/mattn/go-sqlite3"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
+// dbManager keeps the state in SQLite or PostgreSQL.
 type dbManager struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect *sqlDialect
+
+	// Statements are prepared on first use, and kept by their query
+	// as written in this file.
+	stmts_lock sync.Mutex
+	stmts      map[string]*sql.Stmt
 }
 
-func NewDBManager(db *sql.DB) *dbManager {
+func NewDBManager(conf *Config) (*dbManager, error) {
+	var dialect *sqlDialect
+	switch conf.Storage {
+	case STORAGE_POSTGRES:
+		dialect = postgresDialect
+	default:
+		dialect = sqliteDialect
+	}
+	db, err := sql.Open(dialect.driver, dialect.dsn(conf.Database))
+	if err != nil {
+		return nil, err
+	}
+	// Each connection prepares the statements again, so keep one for
+	// every worker instead of closing all but two.
+	db.SetMaxIdleConns(conf.Workers + 1)
 	return &dbManager{
-		db: db,
+		db:      db,
+		dialect: dialect,
+		stmts:   make(map[string]*sql.Stmt),
+	}, nil
+}
+
+// NewReadOnlyDBManager opens the database only to look at it.
+// A SQLite database that does not exist is an error, not created.
+func NewReadOnlyDBManager(conf *Config) (*dbManager, error) {
+	if conf.Storage == STORAGE_POSTGRES {
+		return NewDBManager(conf)
+	}
+	path, _, _ := strings.Cut(strings.TrimPrefix(conf.Database, "file:"), "?")
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(sqliteDialect.driver, "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
 	}
+	return &dbManager{
+		db:      db,
+		dialect: sqliteDialect,
+		stmts:   make(map[string]*sql.Stmt),
+	}, nil
 }
 
-func (dbm *dbManager) CreateTables() (err error) {
-	_, err = dbm.db.Exec("CREATE TABLE IF NOT EXISTS admin (user INTEGER PRIMARY KEY)")
+// sql adapts a query to the dialect.
+func (dbm *dbManager) sql(query string) string {
+	return dbm.dialect.rebind(query)
+}
+
+// prepare returns the statement of the query, bound to tx if it is not nil.
+func (dbm *dbManager) prepare(tx *sql.Tx, query string) (stmt *sql.Stmt, err error) {
+	dbm.stmts_lock.Lock()
+	stmt, ok := dbm.stmts[query]
+	if !ok {
+		stmt, err = dbm.db.Prepare(dbm.sql(query))
+		if err != nil {
+			dbm.stmts_lock.Unlock()
+			return
+		}
+		dbm.stmts[query] = stmt
+	}
+	dbm.stmts_lock.Unlock()
+	if tx != nil {
+		stmt = tx.Stmt(stmt)
+	}
+	return
+}
+
+func (dbm *dbManager) exec(tx *sql.Tx, query string, args ...interface{}) (res sql.Result, err error) {
+	stmt, err := dbm.prepare(tx, query)
 	if err != nil {
 		return
 	}
-	_, err = dbm.db.Exec("CREATE TABLE IF NOT EXISTS invite (user INTEGER PRIMARY KEY, topic TEXT)")
+	return stmt.Exec(args...)
+}
+
+func (dbm *dbManager) query(tx *sql.Tx, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	stmt, err := dbm.prepare(tx, query)
 	if err != nil {
 		return
 	}
-	_, err = dbm.db.Exec("CREATE TABLE IF NOT EXISTS lobby (user INTEGER PRIMARY KEY, room INTEGER)")
+	return stmt.Query(args...)
+}
+
+func (dbm *dbManager) queryRow(tx *sql.Tx, query string, args ...interface{}) rowScanner {
+	stmt, err := dbm.prepare(tx, query)
 	if err != nil {
-		return
+		return errRow{err}
+	}
+	return stmt.QueryRow(args...)
+}
+
+// errRow is what queryRow returns if the statement cannot be prepared.
+type errRow struct {
+	err error
+}
+
+func (row errRow) Scan(dest ...interface{}) error {
+	return row.err
+}
+
+func (dbm *dbManager) Close() error {
+	dbm.stmts_lock.Lock()
+	for query, stmt := range dbm.stmts {
+		stmt.Close()
+		delete(dbm.stmts, query)
 	}
-	_, err = dbm.db.Exec("CREATE TABLE IF NOT EXISTS chat (user_a INTEGER PRIMARY KEY, user_b INTEGER)")
+	dbm.stmts_lock.Unlock()
+	return dbm.db.Close()
+}
+
+// CreateTables brings the schema up to date.
+func (dbm *dbManager) CreateTables() (err error) {
+	pending, err := dbm.PendingMigrations()
 	if err != nil {
 		return
 	}
-	_, err = dbm.db.Exec("CREATE TABLE IF NOT EXISTS banlist (user INTEGER PRIMARY KEY)")
+	for _, m := range pending {
+		err = dbm.applyMigration(m)
+		if err != nil {
+			return fmt.Errorf("migration %v: %v", m, err)
+		}
+		log.Printf("Applied migration %v\n", m)
+	}
 	return
 }
 
-// Users
+// SchemaVersion returns 0 for a database that has never been migrated.
+func (dbm *dbManager) SchemaVersion() (version int, err error) {
+	var count int
+	err = dbm.db.QueryRow(dbm.dialect.has_schema_version).Scan(&count)
+	if err != nil || count == 0 {
+		return
+	}
+	err = dbm.db.QueryRow(dbm.sql("SELECT coalesce(max(version), 0) FROM schema_version")).Scan(&version)
+	return
+}
 
-func (dbm *dbManager) GetActiveUsers() (chat int, lobby int, err error) {
-	err = dbm.db.QueryRow("SELECT count(*) FROM chat").Scan(&chat)
+func (dbm *dbManager) PendingMigrations() (pending []Migration, err error) {
+	migrations, err := LoadMigrations(dbm.dialect.name)
 	if err != nil {
 		return
 	}
-	err = dbm.db.QueryRow("SELECT count(*) FROM lobby").Scan(&lobby)
-	return
+	version, err := dbm.SchemaVersion()
+	if err != nil {
+		return
+	}
+	return pendingMigrations(migrations, version)
 }
 
-func (dbm *dbManager) ListAllUsers() (users []int64, err error) {
-	rows, err := dbm.db.Query("SELECT user_a FROM chat ORDER BY random()")
+func (dbm *dbManager) applyMigration(m Migration) (err error) {
+	tx, err := dbm.db.Begin()
 	if err != nil {
 		return
 	}
-	{
-		defer rows.Close()
-		for rows.Next() {
-			var user int64
-			err = rows.Scan(&user)
-			if err != nil {
-				return
-			}
-			users = append(users, user)
-		}
-		err = rows.Err()
+	if dbm.dialect.lock_migrations != "" {
+		_, err = tx.Exec(dbm.dialect.lock_migrations)
 		if err != nil {
+			tx.Rollback()
 			return
 		}
 	}
-	rows, err = dbm.db.Query("SELECT user FROM lobby ORDER BY random()")
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, applied_at BIGINT NOT NULL)")
 	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	// Another process may have applied it while we were waiting for the lock.
+	var count int
+	err = tx.QueryRow(dbm.sql("SELECT count(*) FROM schema_version WHERE version = ?"), m.Version).Scan(&count)
+	if err != nil || count != 0 {
+		tx.Rollback()
 		return
 	}
-	{
-		defer rows.Close()
-		for rows.Next() {
-			var user int64
-			err = rows.Scan(&user)
-			if err != nil {
-				return
-			}
-			users = append(users, user)
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{m.Script, nil},
+		{dbm.sql("INSERT INTO schema_version (version, applied_at) VALUES (?, ?)"), []interface{}{m.Version, time.Now().Unix()}},
+	}
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt.query, stmt.args...)
+		if err != nil {
+			tx.Rollback()
+			return
 		}
-		err = rows.Err()
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		tx.Rollback()
+	}
+	return
+}
+
+// Updates
+
+// How many recent update IDs are remembered for deduplication.
+const PROCESSED_UPDATE_WINDOW = 10000
+
+// GetUpdateOffset returns the first update received but not handled,
+// or the one after the last handled if there is none.
+func (dbm *dbManager) GetUpdateOffset() (offset int, err error) {
+	err = dbm.queryRow(nil, `SELECT coalesce(
+		(SELECT min(id) FROM processed_update WHERE handled = 0),
+		(SELECT max(id) + 1 FROM processed_update),
+		0)`).Scan(&offset)
+	return
+}
+
+// MarkUpdateReceived records the update ID before it is handled.
+// It returns true if the update has been handled before.
+func (dbm *dbManager) MarkUpdateReceived(id int) (handled bool, err error) {
+	_, err = dbm.exec(nil, "INSERT INTO processed_update (id, handled) VALUES (?, 0) ON CONFLICT DO NOTHING", id)
+	if err != nil {
+		return
+	}
+	var flag int
+	err = dbm.queryRow(nil, "SELECT handled FROM processed_update WHERE id = ?", id).Scan(&flag)
+	if err != nil {
+		return
+	}
+	if id%100 == 0 {
+		_, err = dbm.exec(nil, "DELETE FROM processed_update WHERE id < ?", id-PROCESSED_UPDATE_WINDOW)
+	}
+	return flag != 0, err
+}
+
+// MarkUpdateProcessed records that the update has been handled.
+func (dbm *dbManager) MarkUpdateProcessed(id int) (err error) {
+	_, err = dbm.exec(nil, "UPDATE processed_update SET handled = 1 WHERE id = ?", id)
+	return
+}
+
+func (dbm *dbManager) StateVersion() (version int64, err error) {
+	err = dbm.queryRow(nil, "SELECT version FROM state_version").Scan(&version)
+	return
+}
+
+// BumpStateVersion sets a version never used before, even across a restore.
+func (dbm *dbManager) BumpStateVersion() (err error) {
+	_, err = dbm.exec(nil, "UPDATE state_version SET version = ?", time.Now().UnixNano())
+	return
+}
+
+// Users
+
+func scanUsers(rows *sql.Rows) (users []int64, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var user int64
+		err = rows.Scan(&user)
 		if err != nil {
 			return
 		}
+		users = append(users, user)
 	}
+	err = rows.Err()
 	return
 }
 
-// Chats
+func (dbm *dbManager) GetUser(user int64) (status UserStatus, err error) {
+	err = dbm.queryRow(nil, `SELECT state, room, topic, partner FROM users WHERE "user" = ?`, user).Scan(&status.State, &status.Room, &status.Topic, &status.Partner)
+	if err == sql.ErrNoRows {
+		return UserStatus{State: USER_DISCONNECTED}, nil
+	}
+	return
+}
 
-func (dbm *dbManager) ConnectChat(user_a int64, user_b int64) (err error) {
-	tx, err := dbm.db.Begin()
+func (dbm *dbManager) TransitionUser(user int64, from UserState, to UserStatus) (err error) {
+	err = checkUserTransition(from, to.State)
+	if err != nil {
+		return
+	}
+	var res sql.Result
+	if from == USER_DISCONNECTED {
+		res, err = dbm.exec(nil, `INSERT INTO users ("user", state, room, topic, partner) VALUES (?, ?, ?, ?, ?) ON CONFLICT ("user") DO UPDATE SET state = excluded.state, room = excluded.room, topic = excluded.topic, partner = excluded.partner WHERE users.state = ?`, user, to.State, to.Room, to.Topic, to.Partner, from)
+	} else {
+		res, err = dbm.exec(nil, `UPDATE users SET state = ?, room = ?, topic = ?, partner = ? WHERE "user" = ? AND state = ?`, to.State, to.Room, to.Topic, to.Partner, user, from)
+	}
+	if err != nil {
+		return
+	}
+	affected, err := res.RowsAffected()
 	if err != nil {
 		return
 	}
+	if affected == 0 {
+		return ErrStateChanged
+	}
+	return
+}
 
-	_, err = tx.Exec("INSERT OR REPLACE INTO chat VALUES (?, ?)", user_a, user_b)
+// KickUser disconnects the user from whatever state it is in.
+// It returns the partner left alone in the chat, or 0.
+func (dbm *dbManager) KickUser(user int64) (partner int64, err error) {
+	tx, err := dbm.db.Begin()
 	if err != nil {
-		tx.Rollback()
 		return
 	}
 
-	_, err = tx.Exec("INSERT OR REPLACE INTO chat VALUES (?, ?)", user_b, user_a)
+	partner, err = dbm.kickUser(tx, user)
 	if err != nil {
 		tx.Rollback()
 		return
@@ -132,100 +353,155 @@ func (dbm *dbManager) ConnectChat(user_a int64, user_b int64) (err error) {
 	if err != nil {
 		tx.Rollback()
 	}
-
 	return
 }
 
-func (dbm *dbManager) DisconnectChat(user_a int64, user_b int64) (err error) {
-	if user_b != 0 {
-		_, err = dbm.db.Exec("UPDATE chat SET user_b = 0 WHERE user_a = ?", user_b)
+func (dbm *dbManager) kickUser(tx *sql.Tx, user int64) (partner int64, err error) {
+	err = dbm.queryRow(tx, `UPDATE users SET partner = 0 WHERE state = ? AND partner = ? RETURNING "user"`, USER_CHATTING, user).Scan(&partner)
+	if err == sql.ErrNoRows {
+		partner, err = 0, nil
+	} else if err != nil {
+		return
 	}
-	_, err1 := dbm.db.Exec("DELETE FROM chat WHERE user_a = ?", user_a)
+
+	_, err = dbm.exec(tx, `UPDATE users SET state = ?, topic = '', partner = 0 WHERE "user" = ?`, USER_DISCONNECTED, user)
+	return
+}
+
+func (dbm *dbManager) GetActiveUsers() (chat int, lobby int, err error) {
+	err = dbm.queryRow(nil, "SELECT count(*) FILTER (WHERE state = ?), count(*) FILTER (WHERE state IN (?, ?, ?)) FROM users", USER_CHATTING, USER_LOBBY, USER_TYPING_TOPIC, USER_WAITING).Scan(&chat, &lobby)
+	return
+}
+
+func (dbm *dbManager) ListAllUsers() (users []int64, err error) {
+	rows, err := dbm.query(nil, `SELECT "user" FROM users WHERE state != ? ORDER BY random()`, USER_DISCONNECTED)
 	if err != nil {
 		return
 	}
-	return err1
+	return scanUsers(rows)
 }
 
-func (dbm *dbManager) QueryChat(user_a int64) (user_b int64, err error) {
-	err = dbm.db.QueryRow("SELECT user_b FROM chat WHERE user_a = ? LIMIT 1", user_a).Scan(&user_b)
+// RecordActivity notes the user has been heard from now.
+func (dbm *dbManager) RecordActivity(user int64, now time.Time) (err error) {
+	_, err = dbm.exec(nil, `INSERT INTO users ("user", state, first_seen, last_active) VALUES (?, ?, ?, ?) ON CONFLICT ("user") DO UPDATE SET last_active = excluded.last_active WHERE users.last_active < excluded.last_active`, user, USER_DISCONNECTED, now.Unix(), now.Unix())
 	return
 }
 
-func (dbm *dbManager) ListUnmatchedUsers() (users []int64, err error) {
-	rows, err := dbm.db.Query("SELECT user FROM lobby ORDER BY random()")
+func (dbm *dbManager) GetUserActivity(user int64) (activity UserActivity, err error) {
+	var first_seen, last_active int64
+	err = dbm.queryRow(nil, `SELECT first_seen, last_active FROM users WHERE "user" = ?`, user).Scan(&first_seen, &last_active)
+	if err == sql.ErrNoRows {
+		return UserActivity{}, nil
+	}
+	activity.FirstSeen, activity.LastActive = timeOrZero(first_seen), timeOrZero(last_active)
+	return
+}
+
+// ExpireIdleUsers disconnects the users in the lobby who have not been
+// heard from since idle_since, and returns them.
+func (dbm *dbManager) ExpireIdleUsers(idle_since time.Time) (users []int64, err error) {
+	rows, err := dbm.query(nil, `UPDATE users SET state = ?, topic = '' WHERE state IN (?, ?, ?) AND last_active < ? RETURNING "user"`, USER_DISCONNECTED, USER_LOBBY, USER_TYPING_TOPIC, USER_WAITING, idle_since.Unix())
 	if err != nil {
 		return
 	}
-	{
-		defer rows.Close()
-		for rows.Next() {
-			var user int64
-			err = rows.Scan(&user)
-			if err != nil {
-				return
-			}
-			users = append(users, user)
-		}
-		err = rows.Err()
-		if err != nil {
-			return
-		}
+	return scanUsers(rows)
+}
+
+// Chats
+
+// LeaveChat ends the chat and puts the user back to the lobby.
+// It returns the partner, or 0 if the partner has already left.
+func (dbm *dbManager) LeaveChat(user_a int64) (user_b int64, err error) {
+	tx, err := dbm.db.Begin()
+	if err != nil {
+		return
+	}
+
+	err = dbm.queryRow(tx, `SELECT partner FROM users WHERE "user" = ? AND state = ?`, user_a, USER_CHATTING).Scan(&user_b)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return 0, ErrStateChanged
 	}
-	rows, err = dbm.db.Query("SELECT user_a FROM chat WHERE user_b = 0 ORDER BY random()")
 	if err != nil {
+		tx.Rollback()
 		return
 	}
-	{
-		defer rows.Close()
-		for rows.Next() {
-			var user int64
-			err = rows.Scan(&user)
-			if err != nil {
-				return
-			}
-			users = append(users, user)
-		}
-		err = rows.Err()
+
+	_, err = dbm.exec(tx, `UPDATE users SET state = ?, room = 0, partner = 0 WHERE "user" = ?`, USER_LOBBY, user_a) // TODO: more lobbies
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	if user_b != 0 {
+		_, err = dbm.exec(tx, `UPDATE users SET partner = 0 WHERE "user" = ? AND state = ? AND partner = ?`, user_b, USER_CHATTING, user_a)
 		if err != nil {
+			tx.Rollback()
 			return
 		}
 	}
-	return
-}
-
-// Invitations
 
-func (dbm *dbManager) NewInvitation(user int64, topic string) (err error) {
-	_, err = dbm.db.Exec("INSERT OR REPLACE INTO invite VALUES (?, ?)", user, topic)
+	err = tx.Commit()
+	if err != nil {
+		tx.Rollback()
+	}
 	return
 }
 
-func (dbm *dbManager) NewPendingInvitation(user int64) (err error) {
-	_, err = dbm.db.Exec("INSERT OR REPLACE INTO invite VALUES (?, NULL)", user)
-	return
+func (dbm *dbManager) ListUnmatchedUsers() (users []int64, err error) {
+	rows, err := dbm.query(nil, `SELECT "user" FROM users WHERE state IN (?, ?, ?) OR (state = ? AND partner = 0) ORDER BY random()`, USER_LOBBY, USER_TYPING_TOPIC, USER_WAITING, USER_CHATTING)
+	if err != nil {
+		return
+	}
+	return scanUsers(rows)
 }
 
-func (dbm *dbManager) RemoveInvitation(user int64) (err error) {
-	_, err = dbm.db.Exec("DELETE FROM invite WHERE user = ?", user)
-	return
-}
+// Invitations
 
-func (dbm *dbManager) RemoveInvitationByTopic(topic string) (err error) {
-	_, err = dbm.db.Exec("DELETE FROM invite WHERE topic = ?", topic)
-	return
-}
+// ClaimInvitation pairs user_a with the inviter waiting on topic, all in one
+// transaction, so two users tapping the same invitation never both get it.
+// It fails with ErrInvitationTaken if nobody else is waiting on the topic.
+func (dbm *dbManager) ClaimInvitation(user_a int64, topic string) (user_b int64, err error) {
+	tx, err := dbm.db.Begin()
+	if err != nil {
+		return
+	}
 
-func (dbm *dbManager) QueryInvitation(topic string) (user int64, err error) {
-	err = dbm.db.QueryRow("SELECT user FROM invite WHERE topic = ? LIMIT 1", topic).Scan(&user)
+	// On SQLite the transaction already holds the write lock. On PostgreSQL
+	// the row is locked, and the state checked again after waiting for it.
+	err = dbm.queryRow(tx, `UPDATE users SET state = ?, topic = '', partner = ? WHERE "user" = (SELECT "user" FROM users WHERE state = ? AND topic = ? AND "user" != ? ORDER BY "user" LIMIT 1`+dbm.dialect.skip_locked+`) AND state = ? AND topic = ? RETURNING "user"`, USER_CHATTING, user_a, USER_WAITING, topic, user_a, USER_WAITING, topic).Scan(&user_b)
 	if err == sql.ErrNoRows {
-		return 0, nil
+		tx.Rollback()
+		return 0, ErrInvitationTaken
+	} else if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	res, err := dbm.exec(tx, `UPDATE users SET state = ?, topic = '', partner = ? WHERE "user" = ? AND state IN (?, ?, ?)`, USER_CHATTING, user_b, user_a, USER_LOBBY, USER_TYPING_TOPIC, USER_WAITING)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	if affected == 0 {
+		tx.Rollback()
+		return 0, ErrStateChanged
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		tx.Rollback()
 	}
 	return
 }
 
 func (dbm *dbManager) ListInvites() (topics []string, err error) {
-	rows, err := dbm.db.Query("SELECT topic FROM invite WHERE topic IS NOT NULL ORDER BY random()")
+	rows, err := dbm.query(nil, "SELECT topic FROM users WHERE state = ? ORDER BY random()", USER_WAITING)
 	if err != nil {
 		return
 	}
@@ -244,96 +520,221 @@ func (dbm *dbManager) ListInvites() (topics []string, err error) {
 
 // Lobbies
 
-func (dbm *dbManager) JoinLobby(user int64, room int64) (err error) {
-	_, err = dbm.db.Exec("INSERT OR REPLACE INTO lobby VALUES (?, ?)", user, room)
-	return
+func (dbm *dbManager) ListUsersInLobby(room int64) (users []int64, err error) {
+	rows, err := dbm.query(nil, `SELECT "user" FROM users WHERE state IN (?, ?, ?) AND room = ? ORDER BY random()`, USER_LOBBY, USER_TYPING_TOPIC, USER_WAITING, room)
+	if err != nil {
+		return
+	}
+	return scanUsers(rows)
 }
 
-func (dbm *dbManager) LeaveLobby(user int64) (err error) {
-	_, err = dbm.db.Exec("DELETE FROM lobby WHERE user = ?", user)
+// Outbox
+
+// AddToOutbox stores the messages and sets their IDs.
+func (dbm *dbManager) AddToOutbox(entries []OutboxEntry) (err error) {
+	tx, err := dbm.db.Begin()
+	if err != nil {
+		return
+	}
+
+	for i := range entries {
+		err = dbm.queryRow(tx, "INSERT INTO outbox (priority, kind, body) VALUES (?, ?, ?) RETURNING id", entries[i].Priority, entries[i].Kind, entries[i].Body).Scan(&entries[i].ID)
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		tx.Rollback()
+	}
 	return
 }
 
-func (dbm *dbManager) QueryLobby(user int64) (room int64, err error) {
-	err = dbm.db.QueryRow("SELECT room FROM lobby WHERE user = ?", user).Scan(&room)
+func (dbm *dbManager) RemoveFromOutbox(id int64) (err error) {
+	_, err = dbm.exec(nil, "DELETE FROM outbox WHERE id = ?", id)
 	return
 }
 
-func (dbm *dbManager) ListUsersInLobby(room int64) (users []int64, err error) {
-	rows, err := dbm.db.Query("SELECT user FROM lobby WHERE room = ? ORDER BY random()", room)
+// ListOutbox returns the messages in the order they were added.
+func (dbm *dbManager) ListOutbox() (entries []OutboxEntry, err error) {
+	rows, err := dbm.query(nil, "SELECT id, priority, kind, body FROM outbox ORDER BY id")
 	if err != nil {
 		return
 	}
-	{
-		defer rows.Close()
-		for rows.Next() {
-			var user int64
-			err = rows.Scan(&user)
-			if err != nil {
-				return
-			}
-			users = append(users, user)
-		}
-		err = rows.Err()
+	defer rows.Close()
+	for rows.Next() {
+		var entry OutboxEntry
+		err = rows.Scan(&entry.ID, &entry.Priority, &entry.Kind, &entry.Body)
 		if err != nil {
 			return
 		}
+		entries = append(entries, entry)
 	}
+	err = rows.Err()
 	return
 }
 
-// Status
+// Administration
 
-func (dbm *dbManager) IsUserInChat(user int64) (ok bool, err error) {
-	var count int
-	err = dbm.db.QueryRow("SELECT count(*) FROM chat WHERE user_a = ?", user).Scan(&count)
+func (dbm *dbManager) AddAdmin(user int64) (err error) {
+	_, err = dbm.exec(nil, "INSERT INTO admin VALUES (?) ON CONFLICT DO NOTHING", user)
+	return
+}
+
+func (dbm *dbManager) RemoveAdmin(user int64) (err error) {
+	_, err = dbm.exec(nil, `DELETE FROM admin WHERE "user" = ?`, user)
+	return
+}
+
+// BanUser puts the user in the banlist and kicks it, all at once.
+// Banning a user again replaces the old ban.
+// It returns the partner left alone in the chat, or 0.
+func (dbm *dbManager) BanUser(ban Ban) (partner int64, err error) {
+	tx, err := dbm.db.Begin()
 	if err != nil {
-		return false, err
+		return
 	}
-	return count != 0, nil
-}
 
-func (dbm *dbManager) IsUserInLobby(user int64) (ok bool, err error) {
-	var count int
-	err = dbm.db.QueryRow("SELECT count(*) FROM lobby WHERE user = ?", user).Scan(&count)
+	_, err = dbm.exec(tx, `INSERT INTO banlist ("user", reason, admin, created_at, expires_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT ("user") DO UPDATE SET reason = excluded.reason, admin = excluded.admin, created_at = excluded.created_at, expires_at = excluded.expires_at, appeal = 0, appeal_text = ''`, ban.User, ban.Reason, ban.Admin, unixOrZero(ban.CreatedAt), unixOrZero(ban.ExpiresAt))
 	if err != nil {
-		return false, err
+		tx.Rollback()
+		return
 	}
-	return count != 0, nil
+
+	partner, err = dbm.kickUser(tx, ban.User)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		tx.Rollback()
+	}
+	return
 }
 
-func (dbm *dbManager) IsUserTypingTopic(user int64) (ok bool, err error) {
-	var count int
-	err = dbm.db.QueryRow("SELECT count(*) FROM invite WHERE user = ? AND topic IS NULL", user).Scan(&count)
+func (dbm *dbManager) RemoveFromBanList(user int64) (err error) {
+	_, err = dbm.exec(nil, `DELETE FROM banlist WHERE "user" = ?`, user)
+	return
+}
+
+// Status
+
+// liftExpiredBans removes the bans that have ended by now.
+func (dbm *dbManager) liftExpiredBans(now time.Time) (err error) {
+	_, err = dbm.exec(nil, "DELETE FROM banlist WHERE expires_at != 0 AND expires_at <= ?", now.Unix())
+	return
+}
+
+func (dbm *dbManager) ListBans(now time.Time) (bans []Ban, err error) {
+	err = dbm.liftExpiredBans(now)
 	if err != nil {
-		return false, err
+		return
 	}
-	return count != 0, nil
+	rows, err := dbm.query(nil, `SELECT `+BAN_COLUMNS+` FROM banlist ORDER BY "user"`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ban Ban
+		err = scanBan(rows, &ban)
+		if err != nil {
+			return
+		}
+		bans = append(bans, ban)
+	}
+	err = rows.Err()
+	return
 }
 
-func (dbm *dbManager) IsUserInQueue(user int64) (ok bool, err error) {
-	var count int
-	err = dbm.db.QueryRow("SELECT count(*) FROM invite WHERE user = ?", user).Scan(&count)
+func (dbm *dbManager) ListAdmins() (users []int64, err error) {
+	rows, err := dbm.query(nil, `SELECT "user" FROM admin ORDER BY "user"`)
 	if err != nil {
-		return false, err
+		return
 	}
-	return count != 0, nil
+	return scanUsers(rows)
 }
 
 func (dbm *dbManager) IsUserAnAdmin(user int64) (ok bool, err error) {
 	var count int
-	err = dbm.db.QueryRow("SELECT count(*) FROM admin WHERE user = ?", user).Scan(&count)
+	err = dbm.queryRow(nil, `SELECT count(*) FROM admin WHERE "user" = ?`, user).Scan(&count)
 	if err != nil {
 		return false, err
 	}
 	return count != 0, nil
 }
 
-func (dbm *dbManager) IsUserInBanList(user int64) (ok bool, err error) {
-	var count int
-	err = dbm.db.QueryRow("SELECT count(*) FROM banlist WHERE user = ?", user).Scan(&count)
+// GetBan returns nil if the user is not banned.
+// An expired ban is lifted on the way.
+func (dbm *dbManager) GetBan(user int64, now time.Time) (ban *Ban, err error) {
+	var b Ban
+	err = scanBan(dbm.queryRow(nil, `SELECT `+BAN_COLUMNS+` FROM banlist WHERE "user" = ?`, user), &b)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	if b.ExpiredAt(now) {
+		_, err = dbm.exec(nil, `DELETE FROM banlist WHERE "user" = ? AND expires_at = ?`, user, b.ExpiresAt.Unix())
+		return nil, err
+	}
+	return &b, nil
+}
+
+// SetAppeal moves the appeal against the ban created at created_at.
+// It fails with ErrStateChanged if the ban has been replaced or lifted,
+// or the appeal is no longer in the from state.
+func (dbm *dbManager) SetAppeal(user int64, created_at time.Time, from AppealState, to AppealState, text string) (err error) {
+	res, err := dbm.exec(nil, `UPDATE banlist SET appeal = ?, appeal_text = ? WHERE "user" = ? AND created_at = ? AND appeal = ?`, to, text, user, unixOrZero(created_at), from)
 	if err != nil {
-		return false, err
+		return
 	}
-	return count != 0, nil
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if affected == 0 {
+		return ErrStateChanged
+	}
+	return
+}
+
+// ResolveAppeal lifts the ban if approved, otherwise rejects the appeal.
+// It fails with ErrStateChanged if the appeal is not pending any more.
+func (dbm *dbManager) ResolveAppeal(user int64, created_at time.Time, approve bool) (err error) {
+	var res sql.Result
+	if approve {
+		res, err = dbm.exec(nil, `DELETE FROM banlist WHERE "user" = ? AND created_at = ? AND appeal = ?`, user, unixOrZero(created_at), APPEAL_PENDING)
+	} else {
+		res, err = dbm.exec(nil, `UPDATE banlist SET appeal = ? WHERE "user" = ? AND created_at = ? AND appeal = ?`, APPEAL_REJECTED, user, unixOrZero(created_at), APPEAL_PENDING)
+	}
+	if err != nil {
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if affected == 0 {
+		return ErrStateChanged
+	}
+	return
+}
+
+const BAN_COLUMNS = `"user", reason, admin, created_at, expires_at, appeal, appeal_text`
+
+// Both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanBan(row rowScanner, ban *Ban) (err error) {
+	var created_at, expires_at int64
+	err = row.Scan(&ban.User, &ban.Reason, &ban.Admin, &created_at, &expires_at, &ban.Appeal, &ban.AppealText)
+	ban.CreatedAt, ban.ExpiresAt = timeOrZero(created_at), timeOrZero(expires_at)
+	return
 }
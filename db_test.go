@@ -0,0 +1,57 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The dry run of the migrations neither creates nor changes the database.
+func TestReadOnlyDBManager(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	conf := NewConfig()
+	conf.Database = path
+	_, err := NewReadOnlyDBManager(conf)
+	if err == nil {
+		t.Fatal("opened a database that does not exist")
+	}
+	_, err = os.Stat(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("the database was created: %v", err)
+	}
+
+	newTestSQLite(t, path).Close()
+	dbm, err := NewReadOnlyDBManager(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.Close()
+	pending, err := dbm.PendingMigrations()
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("pending = %v, %v", pending, err)
+	}
+	err = dbm.AddAdmin(1001)
+	if err == nil {
+		t.Fatal("wrote to a read-only database")
+	}
+}
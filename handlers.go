@@ -21,33 +21,43 @@ package main
 import (
 	"fmt"
 	"strings"
-	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
-func (bot *Bot) handleStart(msg *tgbotapi.Message) {
+// queryUser reads the state of the user who sent msg.
+// If cancel_typing is set, a user asked for a topic who sends a command
+// instead gives up the topic and stays in the lobby.
+func (bot *Bot) queryUser(msg *tgbotapi.Message, cancel_typing bool) UserStatus {
 	user_a := msg.Chat.ID
-
-	// Detect whether the user is typing topic.
-	ok, err := bot.dbm.IsUserTypingTopic(user_a)
+	status, err := bot.dbm.GetUser(user_a)
 	if err != nil {
 		bot.replyError(err, msg, true)
 	}
-	if ok {
-		err = bot.dbm.RemoveInvitation(user_a)
-		if err != nil {
+	if cancel_typing && status.State == USER_TYPING_TOPIC {
+		lobby_status := UserStatus{State: USER_LOBBY, Room: status.Room}
+		err = bot.dbm.TransitionUser(user_a, status.State, lobby_status)
+		if err == ErrStateChanged {
+			// Another update moved the user first; go on from there.
+			status, err = bot.dbm.GetUser(user_a)
+			if err != nil {
+				bot.replyError(err, msg, true)
+			}
+		} else if err != nil {
 			bot.replyError(err, msg, false)
+		} else {
+			status = lobby_status
 		}
-		// fall-through
 	}
+	return status
+}
 
-	// Detect whether the user is in chat.
-	ok, err = bot.dbm.IsUserInChat(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
+func (bot *Bot) handleStart(msg *tgbotapi.Message) {
+	user_a := msg.Chat.ID
+	status := bot.queryUser(msg, true)
+
+	switch status.State {
+	case USER_CHATTING:
 		bot.quickReply(
 			"「世界树」\n"+
 				"\n"+
@@ -55,51 +65,16 @@ func (bot *Bot) handleStart(msg *tgbotapi.Message) {
 				"要继续操作的话，请戳 /leave 回到大厅。",
 			msg)
 		return
-	}
-
-	// Detect whether the user is in lobby.
-	ok, err = bot.dbm.IsUserInLobby(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		chat, lobby, err := bot.dbm.GetActiveUsers()
-		if err != nil {
-			bot.replyError(err, msg, true)
-		}
-		user_hash := bot.hashIdentification(msg.Chat)
-		bot.quickReply(fmt.Sprintf(
-			"欢迎使用「世界树」！\n"+
-				"——长夜漫漫，随便找个人，陪你聊到天亮。\n"+
-				"\n"+
-				"世界树有两种聊天模式：大厅群聊、一对一私聊。\n"+
-				"现在正在大厅群聊，你今天的 ID 是 [%s]。\n"+
-				"要建立一对一的私聊，请戳 /new 。\n"+
-				"\n"+
-				"当前有 %d 人连接到世界树，其中 %d 人在大厅。\n"+
-				"若要彻底离开世界树，请戳 /disconnect 。\n"+
-				"请友善待人，遵守道德和法律。",
-			user_hash, chat+lobby, lobby), msg)
-		if !IsOpenHour(time.Now()) && !DEBUG_MODE {
-			bot.quickReply(
-				"「世界树」\n"+
-					"\n"+
-					"\u274c "+CLOSED_MSG,
-				msg)
+	case USER_DISCONNECTED:
+		err := bot.dbm.TransitionUser(user_a, status.State, UserStatus{State: USER_LOBBY, Room: 0}) // TODO: more lobbies
+		if err == ErrStateChanged {
+			bot.replyStateChanged(msg)
 			return
+		} else if err != nil {
+			bot.replyError(err, msg, true)
 		}
-		bot.sendTopicList(user_a,
-			"「世界树」\n"+
-				"\n"+
-				"以下这些是私聊邀请。\n"+
-				"点击感兴趣的话题即可立刻开始私聊：")
-		return
 	}
 
-	err = bot.dbm.JoinLobby(user_a, 0) // TODO: more lobbies
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
 	chat, lobby, err := bot.dbm.GetActiveUsers()
 	if err != nil {
 		bot.replyError(err, msg, true)
@@ -117,11 +92,11 @@ func (bot *Bot) handleStart(msg *tgbotapi.Message) {
 			"若要彻底离开世界树，请戳 /disconnect 。\n"+
 			"请友善待人，遵守道德和法律。",
 		user_hash, chat+lobby, lobby), msg)
-	if !IsOpenHour(time.Now()) && !DEBUG_MODE {
+	if !bot.config.IsOpenHour(bot.clock.Now()) {
 		bot.quickReply(
 			"「世界树」\n"+
 				"\n"+
-				"\u274c "+CLOSED_MSG,
+				"\u274c "+bot.config.Schedule.ClosedMessage(bot.clock.Now()),
 			msg)
 		return
 	}
@@ -135,26 +110,10 @@ func (bot *Bot) handleStart(msg *tgbotapi.Message) {
 func (bot *Bot) handleNew(msg *tgbotapi.Message) {
 	user_a := msg.Chat.ID
 	user_a_nick := bot.hashIdentification(msg.Chat)
+	status := bot.queryUser(msg, true)
 
-	// Detect whether the user is typing topic.
-	ok, err := bot.dbm.IsUserTypingTopic(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		err = bot.dbm.RemoveInvitation(user_a)
-		if err != nil {
-			bot.replyError(err, msg, false)
-		}
-		// fall-through
-	}
-
-	// Detect whether the user is in chat.
-	ok, err = bot.dbm.IsUserInChat(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
+	switch status.State {
+	case USER_CHATTING:
 		bot.quickReply(
 			"「世界树」\n"+
 				"\n"+
@@ -162,18 +121,19 @@ func (bot *Bot) handleNew(msg *tgbotapi.Message) {
 				"要继续操作的话，请戳 /leave 回到大厅。",
 			msg)
 		return
-	}
-
-	// Detect whether the user is in lobby.
-	ok, err = bot.dbm.IsUserInLobby(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
+	case USER_LOBBY, USER_WAITING:
 		topic := strings.TrimSpace(msg.CommandArguments())
+		if strings.HasPrefix(topic, "/") {
+			bot.quickReply(
+				"「世界树」\n"+
+					"\n"+
+					"话题不能以 / 开头。",
+				msg)
+			return
+		}
 		if topic != "" {
 			short_topic := bot.limitTopic(topic)
-			bot.respondTopic(topic, short_topic, user_a, user_a_nick,
+			bot.respondTopic(topic, short_topic, user_a, status, user_a_nick,
 				"「世界树」\n"+
 					"\n"+
 					"你发布了：%s",
@@ -185,16 +145,19 @@ func (bot *Bot) handleNew(msg *tgbotapi.Message) {
 					"或戳 /list 看看还有哪些别的话题。",
 				msg)
 		} else {
-			if !IsOpenHour(time.Now()) && !DEBUG_MODE {
+			if !bot.config.IsOpenHour(bot.clock.Now()) {
 				bot.quickReply(
 					"「世界树」\n"+
 						"\n"+
-						"\u274c "+CLOSED_MSG,
+						"\u274c "+bot.config.Schedule.ClosedMessage(bot.clock.Now()),
 					msg)
 				return
 			}
-			err = bot.dbm.NewPendingInvitation(user_a)
-			if err != nil {
+			err := bot.dbm.TransitionUser(user_a, status.State, UserStatus{State: USER_TYPING_TOPIC, Room: status.Room})
+			if err == ErrStateChanged {
+				bot.replyStateChanged(msg)
+				return
+			} else if err != nil {
 				bot.replyError(err, msg, true)
 			}
 			bot.askReply(
@@ -216,50 +179,16 @@ func (bot *Bot) handleNew(msg *tgbotapi.Message) {
 }
 
 func (bot *Bot) handleNick(msg *tgbotapi.Message) {
-	user_a := msg.Chat.ID
-
-	// Detect whether the user is typing topic.
-	ok, err := bot.dbm.IsUserTypingTopic(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		err = bot.dbm.RemoveInvitation(user_a)
-		if err != nil {
-			bot.replyError(err, msg, false)
-		}
-		// fall-through
-	}
+	status := bot.queryUser(msg, true)
 
-	// Detect whether the user is in chat.
-	ok, err = bot.dbm.IsUserInChat(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
+	if status.State == USER_CHATTING || status.State.InLobby() {
 		user_hash := bot.hashIdentification(msg.Chat)
 		bot.quickReply(fmt.Sprintf(
 			"「世界树」\n"+
 				"\n"+
 				"你今天在大厅的 ID 是 [%s]\n"+
-				"北京时间 3:00 会自动更新。",
-			user_hash), msg)
-		return
-	}
-
-	// Detect whether the user is in lobby.
-	ok, err = bot.dbm.IsUserInLobby(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		user_hash := bot.hashIdentification(msg.Chat)
-		bot.quickReply(fmt.Sprintf(
-			"「世界树」\n"+
-				"\n"+
-				"你今天在大厅的 ID 是 [%s]\n"+
-				"北京时间 3:00 会自动更新。",
-			user_hash), msg)
+				"%s 会自动更新。",
+			user_hash, bot.config.Schedule.FormatClock(nextHashRotation(bot.clock.Now()))), msg)
 		return
 	}
 
@@ -274,26 +203,10 @@ func (bot *Bot) handleNick(msg *tgbotapi.Message) {
 
 func (bot *Bot) handleList(msg *tgbotapi.Message) {
 	user_a := msg.Chat.ID
+	status := bot.queryUser(msg, true)
 
-	// Detect whether the user is typing topic.
-	ok, err := bot.dbm.IsUserTypingTopic(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		err = bot.dbm.RemoveInvitation(user_a)
-		if err != nil {
-			bot.replyError(err, msg, false)
-		}
-		// fall-through
-	}
-
-	// Detect whether the user is in chat.
-	ok, err = bot.dbm.IsUserInChat(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
+	switch {
+	case status.State == USER_CHATTING:
 		chat, lobby, err := bot.dbm.GetActiveUsers()
 		if err != nil {
 			bot.replyError(err, msg, true)
@@ -316,14 +229,7 @@ func (bot *Bot) handleList(msg *tgbotapi.Message) {
 				chat+lobby, lobby), msg)
 		}
 		return
-	}
-
-	// Detect whether the user is in lobby.
-	ok, err = bot.dbm.IsUserInLobby(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
+	case status.State.InLobby():
 		chat, lobby, err := bot.dbm.GetActiveUsers()
 		if err != nil {
 			bot.replyError(err, msg, true)
@@ -363,16 +269,16 @@ func (bot *Bot) handleList(msg *tgbotapi.Message) {
 
 func (bot *Bot) handleLeave(msg *tgbotapi.Message) {
 	user_a := msg.Chat.ID
+	status := bot.queryUser(msg, false)
 
-	// Detect whether the user is typing topic.
-	ok, err := bot.dbm.IsUserTypingTopic(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		err = bot.dbm.RemoveInvitation(user_a)
-		if err != nil {
-			bot.replyError(err, msg, false)
+	switch status.State {
+	case USER_TYPING_TOPIC, USER_WAITING:
+		err := bot.dbm.TransitionUser(user_a, status.State, UserStatus{State: USER_LOBBY, Room: status.Room})
+		if err == ErrStateChanged {
+			bot.replyStateChanged(msg)
+			return
+		} else if err != nil {
+			bot.replyError(err, msg, true)
 		}
 		bot.quickReply(
 			"「世界树」\n"+
@@ -381,25 +287,12 @@ func (bot *Bot) handleLeave(msg *tgbotapi.Message) {
 				"并回到了大厅。",
 			msg)
 		return
-	}
-
-	// Detect whether the user is in chat.
-	ok, err = bot.dbm.IsUserInChat(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		user_b, err := bot.dbm.QueryChat(user_a)
-		if err != nil {
-			bot.replyError(err, msg, false)
-		}
-		err = bot.dbm.DisconnectChat(user_a, user_b)
-		if err != nil {
-			bot.replyError(err, msg, false)
-		}
-
-		err = bot.dbm.JoinLobby(user_a, 0) // TODO: more lobbies
-		if err != nil {
+	case USER_CHATTING:
+		user_b, err := bot.dbm.LeaveChat(user_a)
+		if err == ErrStateChanged {
+			bot.replyStateChanged(msg)
+			return
+		} else if err != nil {
 			bot.replyError(err, msg, true)
 		}
 
@@ -422,44 +315,10 @@ func (bot *Bot) handleLeave(msg *tgbotapi.Message) {
 				"点击感兴趣的话题即可立刻开始私聊：")
 
 		if user_b != 0 {
-			reply := tgbotapi.NewMessage(user_b,
-				"「世界树」\n"+
-					"\n"+
-					"对方结束了本次私聊。\n"+
-					"戳 /leave 回到大厅。")
-			_, err = bot.api.Send(reply)
-			if err != nil {
-				bot.replyError(err, msg, true)
-			}
+			bot.queue.Send(QUEUE_PRIORITY_HIGH, []tgbotapi.Chattable{partnerLeftMessage(user_b)}, nil)
 		}
 		return
-	}
-
-	// Detect whether the user is in queue.
-	ok, err = bot.dbm.IsUserInQueue(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		err := bot.dbm.RemoveInvitation(user_a)
-		if err != nil {
-			bot.replyError(err, msg, true)
-		}
-		bot.quickReply(
-			"「世界树」\n"+
-				"\n"+
-				"已撤销你发布的私聊邀请，\n"+
-				"并回到了大厅。",
-			msg)
-		return
-	}
-
-	// Detect whether the user is in lobby.
-	ok, err = bot.dbm.IsUserInLobby(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
+	case USER_LOBBY:
 		bot.quickReply(
 			"「世界树」\n"+
 				"\n"+
@@ -480,26 +339,10 @@ func (bot *Bot) handleLeave(msg *tgbotapi.Message) {
 
 func (bot *Bot) handleDisconnect(msg *tgbotapi.Message) {
 	user_a := msg.Chat.ID
+	status := bot.queryUser(msg, true)
 
-	// Detect whether the user is typing topic.
-	ok, err := bot.dbm.IsUserTypingTopic(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		err = bot.dbm.RemoveInvitation(user_a)
-		if err != nil {
-			bot.replyError(err, msg, false)
-		}
-		// fall-through
-	}
-
-	// Detect whether the user is in chat.
-	ok, err = bot.dbm.IsUserInChat(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
+	switch {
+	case status.State == USER_CHATTING:
 		bot.quickReply(
 			"「世界树」\n"+
 				"\n"+
@@ -507,20 +350,12 @@ func (bot *Bot) handleDisconnect(msg *tgbotapi.Message) {
 				"要继续操作的话，请戳 /leave 回到大厅。",
 			msg)
 		return
-	}
-
-	// Detect whether the user is in lobby.
-	ok, err = bot.dbm.IsUserInLobby(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		err = bot.dbm.RemoveInvitation(user_a)
-		if err != nil {
-			bot.replyError(err, msg, false)
-		}
-		err = bot.dbm.LeaveLobby(user_a)
-		if err != nil {
+	case status.State.InLobby():
+		err := bot.dbm.TransitionUser(user_a, status.State, UserStatus{State: USER_DISCONNECTED, Room: status.Room})
+		if err == ErrStateChanged {
+			bot.replyStateChanged(msg)
+			return
+		} else if err != nil {
 			bot.replyError(err, msg, false)
 		}
 		bot.quickReply(
@@ -547,16 +382,13 @@ func (bot *Bot) handleDisconnect(msg *tgbotapi.Message) {
 func (bot *Bot) handleMessage(msg *tgbotapi.Message) {
 	user_a := msg.Chat.ID
 	user_a_nick := bot.hashIdentification(msg.Chat)
+	status := bot.queryUser(msg, false)
 
-	// Detect whether the user is typing topic.
-	ok, err := bot.dbm.IsUserTypingTopic(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		printLog(msg.From, "(topic) "+msg.Text, false)
+	switch {
+	case status.State == USER_TYPING_TOPIC:
+		bot.printLog(msg.From, "(topic) "+msg.Text, false)
 		topic := strings.TrimSpace(msg.Text)
-		if topic == "" {
+		if topic == "" || strings.HasPrefix(topic, "/") {
 			bot.askReply(
 				"「世界树」\n"+
 					"\n"+
@@ -564,12 +396,16 @@ func (bot *Bot) handleMessage(msg *tgbotapi.Message) {
 				msg)
 			return
 		}
-		err = bot.dbm.RemoveInvitation(user_a)
-		if err != nil {
+		lobby_status := UserStatus{State: USER_LOBBY, Room: status.Room}
+		err := bot.dbm.TransitionUser(user_a, status.State, lobby_status)
+		if err == ErrStateChanged {
+			bot.replyStateChanged(msg)
+			return
+		} else if err != nil {
 			bot.replyError(err, msg, true)
 		}
 		short_topic := bot.limitTopic(topic)
-		bot.respondTopic(topic, short_topic, user_a, user_a_nick,
+		bot.respondTopic(topic, short_topic, user_a, lobby_status, user_a_nick,
 			"「世界树」\n"+
 				"\n"+
 				"你发布了：%s",
@@ -581,20 +417,10 @@ func (bot *Bot) handleMessage(msg *tgbotapi.Message) {
 				"或戳 /list 看看还有哪些别的话题。",
 			msg)
 		return
-	}
-
-	// Detect whether the user is in chat.
-	ok, err = bot.dbm.IsUserInChat(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		printLog(msg.From, msg.Text, true)
+	case status.State == USER_CHATTING:
+		bot.printLog(msg.From, msg.Text, true)
 
-		user_b, err := bot.dbm.QueryChat(user_a)
-		if err != nil {
-			bot.replyError(err, msg, true)
-		}
+		user_b := status.Partner
 		if user_b == 0 {
 			bot.quickReply(
 				"「世界树」\n"+
@@ -621,32 +447,20 @@ func (bot *Bot) handleMessage(msg *tgbotapi.Message) {
 			bot.replyError(msg_errors[0], msg, false)
 		})
 		return
-	}
-
-	// Detect whether the user is in lobby.
-	ok, err = bot.dbm.IsUserInLobby(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		printLog(msg.From, "(lobby) "+msg.Text, false)
+	case status.State.InLobby():
+		bot.printLog(msg.From, "(lobby) "+msg.Text, false)
 
-		if !IsOpenHour(time.Now()) && !DEBUG_MODE {
+		if !bot.config.IsOpenHour(bot.clock.Now()) {
 			bot.quickReply(
 				"「世界树」\n"+
 					"——长夜漫漫，随便找个人，陪你聊到天亮。\n"+
 					"\n"+
-					"\u274c "+CLOSED_MSG,
+					"\u274c "+bot.config.Schedule.ClosedMessage(bot.clock.Now()),
 				msg)
 			return
 		}
 
-		room, err := bot.dbm.QueryLobby(user_a)
-		if err != nil {
-			bot.replyError(err, msg, true)
-		}
-
-		users, err := bot.dbm.ListUsersInLobby(room)
+		users, err := bot.dbm.ListUsersInLobby(status.Room)
 		if err != nil {
 			bot.replyError(err, msg, true)
 		}
@@ -674,7 +488,7 @@ func (bot *Bot) handleMessage(msg *tgbotapi.Message) {
 		return
 	}
 
-	printLog(msg.From, "(disconnected) "+msg.Text, false)
+	bot.printLog(msg.From, "(disconnected) "+msg.Text, false)
 
 	bot.quickReply(
 		"「世界树」\n"+
@@ -687,22 +501,10 @@ func (bot *Bot) handleMessage(msg *tgbotapi.Message) {
 
 func (bot *Bot) handleWall(msg *tgbotapi.Message) {
 	user_a := msg.Chat.ID
-
-	// Detect whether the user is typing topic.
-	ok, err := bot.dbm.IsUserTypingTopic(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		err = bot.dbm.RemoveInvitation(user_a)
-		if err != nil {
-			bot.replyError(err, msg, false)
-		}
-		// fall-through
-	}
+	bot.queryUser(msg, true)
 
 	// Detect whether the user is an admininistrator.
-	ok, err = bot.dbm.IsUserAnAdmin(user_a)
+	ok, err := bot.dbm.IsUserAnAdmin(user_a)
 	if err != nil {
 		bot.replyError(err, msg, true)
 	}
@@ -733,24 +535,13 @@ func (bot *Bot) handleWall(msg *tgbotapi.Message) {
 }
 
 func (bot *Bot) handleInvalid(msg *tgbotapi.Message) {
-	user_a := msg.Chat.ID
+	status := bot.queryUser(msg, false)
 
-	// Detect whether the user is in chat.
-	ok, err := bot.dbm.IsUserInChat(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
+	switch {
+	case status.State == USER_CHATTING:
 		bot.handleMessage(msg)
 		return
-	}
-
-	// Detect whether the user is in lobby.
-	ok, err = bot.dbm.IsUserInLobby(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
+	case status.State.InLobby():
 		bot.quickReply(
 			"「世界树」\n"+
 				"\n"+
@@ -776,42 +567,48 @@ func (bot *Bot) handleCallbackQuery(query *tgbotapi.CallbackQuery) {
 	}
 	user_a := msg.Chat.ID
 	user_a_nick := bot.hashIdentification(msg.Chat)
+	bot.recordActivity(user_a)
+
+	ban, err := bot.dbm.GetBan(user_a, bot.clock.Now())
+	if err != nil {
+		bot.replyError(err, msg, true)
+	}
+	if ban != nil {
+		// Only /appeal is left to banned users, not even old buttons.
+		bot.transport.AnswerCallbackQuery(tgbotapi.CallbackConfig{
+			CallbackQueryID: query.ID,
+			Text:            "你已被管理员拉黑",
+		})
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(query.Data, APPEAL_CALLBACK_PREFIX):
+		bot.handleAppealCallback(query)
+		return
+	case query.Data == REJOIN_CALLBACK:
+		bot.handleRejoin(query)
+		return
+	case !strings.HasPrefix(query.Data, TOPIC_CALLBACK_PREFIX):
+		return
+	}
 
-	printLog(query.From, "(menu) "+query.Data, false)
+	bot.printLog(query.From, "(menu) "+query.Data, false)
 
-	topic := query.Data
+	topic := strings.TrimPrefix(query.Data, TOPIC_CALLBACK_PREFIX)
 	if topic == "" {
 		return
 	}
-	bot.api.AnswerCallbackQuery(tgbotapi.CallbackConfig{
+	bot.transport.AnswerCallbackQuery(tgbotapi.CallbackConfig{
 		CallbackQueryID: query.ID,
 		Text:            "正在加入：" + topic,
 	})
 
-	// Detect whether the user is typing topic.
-	ok, err := bot.dbm.IsUserTypingTopic(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		err = bot.dbm.RemoveInvitation(user_a)
-		if err != nil {
-			bot.replyError(err, msg, false)
-		}
-		// fall-through
-	}
+	status := bot.queryUser(msg, true)
 
-	// Detect whether the user is in chat.
-	ok, err = bot.dbm.IsUserInChat(user_a)
-	if err != nil {
-		bot.replyError(err, msg, true)
-	}
-	if ok {
-		user_b, err := bot.dbm.QueryChat(user_a)
-		if err != nil {
-			bot.replyError(err, msg, true)
-		}
-		if user_b != 0 {
+	switch status.State {
+	case USER_CHATTING:
+		if status.Partner != 0 {
 			bot.quickReply(
 				"「世界树」\n"+
 					"\n"+
@@ -819,20 +616,28 @@ func (bot *Bot) handleCallbackQuery(query *tgbotapi.CallbackQuery) {
 					"要继续操作的话，请戳 /leave 回到大厅。",
 				msg)
 			return
-		} else {
-			err := bot.dbm.DisconnectChat(user_a, 0)
-			if err != nil {
-				bot.replyError(err, msg, true)
-			}
-			err = bot.dbm.JoinLobby(user_a, 0) // TODO: more lobbies
-			if err != nil {
-				bot.replyError(err, msg, true)
-			}
-			// fall-through
 		}
+		_, err := bot.dbm.LeaveChat(user_a)
+		if err == ErrStateChanged {
+			bot.replyStateChanged(msg)
+			return
+		} else if err != nil {
+			bot.replyError(err, msg, true)
+		}
+		status = UserStatus{State: USER_LOBBY, Room: 0} // TODO: more lobbies
+	case USER_DISCONNECTED:
+		// Tapping an old invitation reconnects to the lobby.
+		err := bot.dbm.TransitionUser(user_a, status.State, UserStatus{State: USER_LOBBY, Room: 0}) // TODO: more lobbies
+		if err == ErrStateChanged {
+			bot.replyStateChanged(msg)
+			return
+		} else if err != nil {
+			bot.replyError(err, msg, true)
+		}
+		status = UserStatus{State: USER_LOBBY, Room: 0}
 	}
 
-	bot.respondTopic(topic, topic, user_a, user_a_nick,
+	bot.respondTopic(topic, topic, user_a, status, user_a_nick,
 		"「世界树」\n"+
 			"\n"+
 			"正在加入话题：%s",
@@ -844,3 +649,12 @@ func (bot *Bot) handleCallbackQuery(query *tgbotapi.CallbackQuery) {
 			"或戳 /list 看看还有哪些别的话题。",
 		msg)
 }
+
+// partnerLeftMessage tells user_b the other side has gone.
+func partnerLeftMessage(user_b int64) tgbotapi.MessageConfig {
+	return tgbotapi.NewMessage(user_b,
+		"「世界树」\n"+
+			"\n"+
+			"对方结束了本次私聊。\n"+
+			"戳 /leave 回到大厅。")
+}
@@ -0,0 +1,538 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+// The scenario harness plays a conversation between virtual users
+// against a bot with a fake transport. Every scenario runs twice,
+// once with in-memory storage and once with a fresh SQLite database.
+// If WORLDTREE_TEST_POSTGRES is set to a connection string, it also runs
+// in a fresh schema of that PostgreSQL database.
+//
+//	go test -run TestScenarios
+//
+// A scenario file is a list of steps, one per line:
+//
+//	# Comments and blank lines are ignored.
+//	time 2026-10-18T22:00:00+08:00   Set the clock.
+//	user alice 1001                  Declare a user with a chat ID.
+//	admin alice                      Make the user an administrator.
+//	ban alice                        Put the user in the banlist.
+//	ban alice 2h 刷屏                 Ban the user for 2 hours, with a reason.
+//	alice says /new 聊聊天            The user sends a message.
+//	alice repeats 10 你好             The user sends the message 10 times
+//	                                 in a row.
+//	alice taps topic:聊聊天           The user taps an inline button.
+//	together bob carol taps topic:聊聊天
+//	                                 Several users tap at the same time.
+//	sweep                            Disconnect the users idle for too long.
+//	took 6s 8s                       Sending what the last step queued took
+//	                                 between 6 and 8 seconds.
+//	alice receives 你发布了            The next unread message contains the text,
+//	                                 either in the body or on a button.
+//	alice receives nothing           The user has no unread messages.
+//	alice fails flood                The next message to the user fails,
+//	                                 see scenarioSendErrors.
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/lib/pq"
+)
+
+const SCENARIO_EXT = ".scenario"
+
+// Give up if the send queue does not settle down in real time.
+const SCENARIO_SETTLE_TIMEOUT = 5 * time.Second
+
+// How far the fake clock moves at a time while the send queue settles.
+const SCENARIO_CLOCK_STEP = 40 * time.Millisecond
+
+type harness struct {
+	clock      *fakeClock
+	transport  *fakeTransport
+	storage    Storage
+	bot        *Bot
+	users      map[string]*tgbotapi.Chat
+	read       map[int64]int
+	update_id  int
+	message_id int
+	// How long the send queue took to settle after the last step.
+	took time.Duration
+	// What NewHarness was given, to restart on the same database.
+	storage_name string
+	dir          string
+	closed       bool
+}
+
+const ENV_TEST_POSTGRES = "WORLDTREE_TEST_POSTGRES"
+
+func scenarioStorages() []string {
+	storages := []string{STORAGE_MEMORY, STORAGE_SQLITE}
+	if os.Getenv(ENV_TEST_POSTGRES) != "" {
+		storages = append(storages, STORAGE_POSTGRES)
+	}
+	return storages
+}
+
+// NewHarness creates a bot with the given storage.
+// A SQLite database is created in dir, a PostgreSQL one in the schema
+// named after dir.
+func NewHarness(storage string, dir string) (h *harness, err error) {
+	conf := NewConfig()
+	conf.Secret = "scenario"
+	conf.Storage = storage
+	conf.Database = filepath.Join(dir, "scenario.db")
+	conf.Backup.Dir = filepath.Join(dir, "backups")
+	conf.Outbox = storage != STORAGE_MEMORY
+	conf.Cache = storage == STORAGE_SQLITE
+	if storage == STORAGE_POSTGRES {
+		conf.Database, err = createScenarioSchema(filepath.Base(dir))
+		if err != nil {
+			return
+		}
+	}
+	h = &harness{
+		clock:        NewFakeClock(time.Date(2017, 1, 1, 22, 0, 0, 0, time.FixedZone("CST", 8*3600))),
+		transport:    NewFakeTransport(),
+		users:        make(map[string]*tgbotapi.Chat),
+		read:         make(map[int64]int),
+		storage_name: storage,
+		dir:          dir,
+	}
+	h.storage, err = NewStorage(conf)
+	if err != nil {
+		return
+	}
+	err = h.storage.CreateTables()
+	if err != nil {
+		h.storage.Close()
+		return
+	}
+	h.bot, err = NewBot(conf, h.clock, h.transport, h.storage)
+	if err != nil {
+		h.storage.Close()
+	}
+	return
+}
+
+// Close stops the bot. It does nothing if the bot is already stopped.
+func (h *harness) Close() {
+	if h.closed {
+		return
+	}
+	h.closed = true
+	h.bot.queue.Shutdown(time.Now().Add(SCENARIO_SETTLE_TIMEOUT))
+	h.storage.Close()
+}
+
+// newTestHarness creates a bot with the given storage for a test or
+// benchmark, and stops it and removes its database when that ends.
+func newTestHarness(t testing.TB, storage string) *harness {
+	t.Helper()
+	dir := t.TempDir()
+	if storage == STORAGE_POSTGRES {
+		t.Cleanup(func() { dropScenarioSchema(filepath.Base(dir)) })
+	}
+	h, err := NewHarness(storage, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	return h
+}
+
+// restartTestHarness stops the bot and starts another one on the same
+// SQLite database, with the update IDs carrying on.
+func restartTestHarness(t testing.TB, h *harness) *harness {
+	t.Helper()
+	h.Close()
+	restarted, err := NewHarness(h.storage_name, h.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(restarted.Close)
+	restarted.update_id = h.update_id
+	return restarted
+}
+
+// TestScenarios runs every scenario file in the scenarios directory.
+func TestScenarios(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("scenarios", "*"+SCENARIO_EXT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("no %s files in scenarios", SCENARIO_EXT)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), SCENARIO_EXT)
+		for _, storage := range scenarioStorages() {
+			t.Run(name+"/"+storage, func(t *testing.T) {
+				err := runScenarioFile(newTestHarness(t, storage), path)
+				if err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+// TestMain keeps the bot quiet unless the tests are run with -v.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+func runScenarioFile(h *harness, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line_no := 0
+	for scanner.Scan() {
+		line_no++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err = h.Step(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: %v", path, line_no, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (h *harness) Step(line string) (err error) {
+	fields := strings.SplitN(line, " ", 3)
+	for len(fields) < 3 {
+		fields = append(fields, "")
+	}
+
+	switch fields[0] {
+	case "time":
+		var t time.Time
+		t, err = time.Parse(time.RFC3339, fields[1])
+		if err != nil {
+			return
+		}
+		h.clock.Set(t)
+		return
+	case "user":
+		var id int64
+		id, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return
+		}
+		h.users[fields[1]] = &tgbotapi.Chat{
+			ID:        id,
+			Type:      "private",
+			FirstName: fields[1],
+		}
+		return
+	case "admin":
+		chat, ok := h.users[fields[1]]
+		if !ok {
+			return fmt.Errorf("unknown user %q", fields[1])
+		}
+		return h.bot.dbm.AddAdmin(chat.ID)
+	case "ban":
+		chat, ok := h.users[fields[1]]
+		if !ok {
+			return fmt.Errorf("unknown user %q", fields[1])
+		}
+		ban := Ban{
+			User:      chat.ID,
+			CreatedAt: h.clock.Now(),
+		}
+		duration, reason, _ := strings.Cut(fields[2], " ")
+		var d time.Duration
+		d, err = ParseBanDuration(duration)
+		if err != nil {
+			return
+		}
+		if d != 0 {
+			ban.ExpiresAt = ban.CreatedAt.Add(d)
+		}
+		ban.Reason = reason
+		_, err = h.bot.dbm.BanUser(ban)
+		return
+	case "together":
+		return h.together(strings.Fields(line)[1:])
+	case "sweep":
+		h.bot.expireIdleUsers()
+		return h.settle()
+	case "took":
+		var min, max time.Duration
+		min, err = time.ParseDuration(fields[1])
+		if err != nil {
+			return
+		}
+		max, err = time.ParseDuration(fields[2])
+		if err != nil {
+			return
+		}
+		if h.took < min || h.took > max {
+			return fmt.Errorf("took %v", h.took)
+		}
+		return
+	}
+
+	chat, ok := h.users[fields[0]]
+	if !ok {
+		return fmt.Errorf("unknown user %q", fields[0])
+	}
+	switch fields[1] {
+	case "says":
+		h.bot.processUpdate(h.newMessageUpdate(chat, fields[2]))
+		return h.settle()
+	case "repeats":
+		count, text, _ := strings.Cut(fields[2], " ")
+		var n int
+		n, err = strconv.Atoi(count)
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; i++ {
+			h.bot.processUpdate(h.newMessageUpdate(chat, text))
+		}
+		return h.settle()
+	case "taps":
+		h.bot.processUpdate(h.newCallbackUpdate(chat, fields[2]))
+		return h.settle()
+	case "receives":
+		return h.expect(chat, fields[2])
+	case "fails":
+		err, ok := scenarioSendErrors[fields[2]]
+		if !ok {
+			return fmt.Errorf("unknown failure %q", fields[2])
+		}
+		h.transport.FailNext(chat.ID, err)
+		return nil
+	default:
+		return fmt.Errorf("unknown step %q", fields[1])
+	}
+}
+
+// The failures a scenario can inject into the next message to a user.
+var scenarioSendErrors = map[string]error{
+	"flood":   tgbotapi.Error{Message: "Too Many Requests: retry after 3", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 3}},
+	"outage":  tgbotapi.Error{Message: "Bad Gateway"},
+	"network": &url.Error{Op: "Post", URL: "https://api.telegram.org/bot/sendMessage", Err: errors.New("read tcp: connection reset by peer")},
+	"blocked": tgbotapi.Error{Message: "Forbidden: bot was blocked by the user"},
+	"deleted": tgbotapi.Error{Message: "Forbidden: user is deactivated"},
+	"gone":    tgbotapi.Error{Message: "Bad Request: chat not found"},
+	"invalid": tgbotapi.Error{Message: "Bad Request: message text is empty"},
+}
+
+func (h *harness) newUser(chat *tgbotapi.Chat) *tgbotapi.User {
+	return &tgbotapi.User{
+		ID:        int(chat.ID),
+		FirstName: chat.FirstName,
+	}
+}
+
+func (h *harness) newMessage(chat *tgbotapi.Chat, text string) *tgbotapi.Message {
+	h.message_id++
+	msg := &tgbotapi.Message{
+		MessageID: h.message_id,
+		From:      h.newUser(chat),
+		Date:      int(h.clock.Now().Unix()),
+		Chat:      chat,
+		Text:      text,
+	}
+	if strings.HasPrefix(text, "/") {
+		length := strings.IndexByte(text, ' ')
+		if length == -1 {
+			length = len(text)
+		}
+		msg.Entities = &[]tgbotapi.MessageEntity{
+			{
+				Type:   "bot_command",
+				Offset: 0,
+				Length: length,
+			},
+		}
+	}
+	return msg
+}
+
+func (h *harness) newMessageUpdate(chat *tgbotapi.Chat, text string) *tgbotapi.Update {
+	h.update_id++
+	return &tgbotapi.Update{
+		UpdateID: h.update_id,
+		Message:  h.newMessage(chat, text),
+	}
+}
+
+func (h *harness) newCallbackUpdate(chat *tgbotapi.Chat, data string) *tgbotapi.Update {
+	h.update_id++
+	return &tgbotapi.Update{
+		UpdateID: h.update_id,
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      strconv.Itoa(h.update_id),
+			From:    h.newUser(chat),
+			Message: h.newMessage(chat, ""),
+			Data:    data,
+		},
+	}
+}
+
+// createScenarioSchema creates an empty schema and returns a connection
+// string that uses it.
+func createScenarioSchema(schema string) (dsn string, err error) {
+	dsn = os.Getenv(ENV_TEST_POSTGRES)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	_, err = db.Exec("CREATE SCHEMA " + pq.QuoteIdentifier(schema))
+	if err != nil {
+		return
+	}
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", err
+		}
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+	return dsn + " search_path=" + schema, nil
+}
+
+func dropScenarioSchema(schema string) {
+	db, err := sql.Open("postgres", os.Getenv(ENV_TEST_POSTGRES))
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	db.Exec("DROP SCHEMA " + pq.QuoteIdentifier(schema) + " CASCADE")
+}
+
+// together sends the updates of several users at once, each in its own
+// goroutine, to shake out races between them.
+func (h *harness) together(fields []string) error {
+	if len(fields) < 3 || fields[len(fields)-2] != "taps" {
+		return errors.New("expected: together NAME... taps DATA")
+	}
+	data := fields[len(fields)-1]
+	var updates []*tgbotapi.Update
+	for _, name := range fields[:len(fields)-2] {
+		chat, ok := h.users[name]
+		if !ok {
+			return fmt.Errorf("unknown user %q", name)
+		}
+		updates = append(updates, h.newCallbackUpdate(chat, data))
+	}
+
+	var wg sync.WaitGroup
+	for _, update := range updates {
+		wg.Add(1)
+		go func(update *tgbotapi.Update) {
+			defer wg.Done()
+			h.bot.processUpdate(update)
+		}(update)
+	}
+	wg.Wait()
+	return h.settle()
+}
+
+// settle waits until the send queue has delivered everything,
+// moving the fake clock along so the rate limits let it.
+func (h *harness) settle() error {
+	start := h.clock.Now()
+	deadline := time.Now().Add(SCENARIO_SETTLE_TIMEOUT)
+	for !h.bot.queue.Idle() {
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for the send queue")
+		}
+		h.clock.Advance(SCENARIO_CLOCK_STEP)
+		time.Sleep(time.Millisecond)
+	}
+	h.took = h.clock.Now().Sub(start)
+	return nil
+}
+
+func (h *harness) expect(chat *tgbotapi.Chat, text string) error {
+	sent := h.transport.SentTo(chat.ID)
+	unread := sent[h.read[chat.ID]:]
+	if text == "nothing" {
+		if len(unread) != 0 {
+			return fmt.Errorf("got %d unread messages, first one: %q", len(unread), describeChattable(unread[0]))
+		}
+		return nil
+	}
+	if len(unread) == 0 {
+		return errors.New("got no message")
+	}
+	h.read[chat.ID]++
+	got := describeChattable(unread[0])
+	if !strings.Contains(got, text) {
+		return fmt.Errorf("got %q", got)
+	}
+	return nil
+}
+
+// describeChattable turns a message into plain text for matching.
+func describeChattable(c tgbotapi.Chattable) string {
+	switch c := c.(type) {
+	case tgbotapi.MessageConfig:
+		text := c.Text
+		if markup, ok := c.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup); ok {
+			for _, row := range markup.InlineKeyboard {
+				for _, button := range row {
+					text += "\n[" + button.Text + "]"
+				}
+			}
+		}
+		return text
+	case tgbotapi.ForwardConfig:
+		return fmt.Sprintf("(forwarded #%d from %d)", c.MessageID, c.FromChatID)
+	default:
+		return fmt.Sprintf("(%T)", c)
+	}
+}
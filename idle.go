@@ -0,0 +1,97 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// How often to look for users idle for Config.IdleTimeout.
+const IDLE_SWEEP_INTERVAL = time.Hour
+
+// Callback data of the button sent to the disconnected users.
+// It cannot be a topic, as topics starting with / are refused.
+const REJOIN_CALLBACK = "/start"
+
+func (bot *Bot) recordActivity(user int64) {
+	err := bot.dbm.RecordActivity(user, bot.clock.Now())
+	if err != nil {
+		log.Printf("Error: %+v\n", err)
+	}
+}
+
+// SweepIdleUsers disconnects the idle users every interval until stop is closed.
+func (bot *Bot) SweepIdleUsers(interval time.Duration, stop <-chan struct{}) {
+	for {
+		select {
+		case <-bot.clock.After(interval):
+		case <-stop:
+			return
+		}
+		bot.expireIdleUsers()
+	}
+}
+
+// expireIdleUsers moves the users who have been quiet in the lobby for
+// too long out of it, so they stop receiving the lobby messages.
+func (bot *Bot) expireIdleUsers() {
+	timeout := time.Duration(bot.config.IdleTimeout) * time.Hour
+	users, err := bot.dbm.ExpireIdleUsers(bot.clock.Now().Add(-timeout))
+	if err != nil {
+		log.Printf("Error: %+v\n", err)
+		return
+	}
+	if len(users) == 0 {
+		return
+	}
+	log.Printf("Disconnected %d idle users.\n", len(users))
+
+	rejoin := REJOIN_CALLBACK
+	reply_markup := tgbotapi.NewInlineKeyboardMarkup(
+		[]tgbotapi.InlineKeyboardButton{
+			{
+				Text:         "\U0001f333 重新连接",
+				CallbackData: &rejoin,
+			},
+		})
+	replies := make([]tgbotapi.Chattable, 0, len(users))
+	for _, user := range users {
+		reply := tgbotapi.NewMessage(user,
+			"「世界树」\n"+
+				"\n"+
+				"你已经很久没有在大厅说话了，为了不打扰你，世界树暂时断开了你的连接。\n"+
+				"想回来的时候，点一下下面的按钮就好。")
+		reply.ReplyMarkup = reply_markup
+		replies = append(replies, reply)
+	}
+	bot.queue.Send(QUEUE_PRIORITY_LOW, replies, nil)
+}
+
+// handleRejoin is the button sent with the notice, and works like /start.
+func (bot *Bot) handleRejoin(query *tgbotapi.CallbackQuery) {
+	bot.printLog(query.From, "(menu) "+query.Data, false)
+	bot.transport.AnswerCallbackQuery(tgbotapi.CallbackConfig{
+		CallbackQueryID: query.ID,
+		Text:            "正在重新连接",
+	})
+	bot.handleStart(query.Message)
+}
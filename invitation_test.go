@@ -0,0 +1,121 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	CLAIM_TEST_ROUNDS    = 50
+	CLAIM_TEST_CLAIMANTS = 8
+)
+
+// Many users tap the same invitation at once, round after round,
+// and each time exactly one of them gets it.
+func TestClaimInvitationRace(t *testing.T) {
+	for _, storage := range scenarioStorages() {
+		t.Run(storage, func(t *testing.T) {
+			h := newTestHarness(t, storage)
+
+			inviter := &tgbotapi.Chat{ID: 1000, Type: "private", FirstName: "inviter"}
+			claimants := make([]*tgbotapi.Chat, CLAIM_TEST_CLAIMANTS)
+			for i := range claimants {
+				claimants[i] = &tgbotapi.Chat{ID: int64(1001 + i), Type: "private", FirstName: fmt.Sprint("claimant", i)}
+			}
+			for _, chat := range append([]*tgbotapi.Chat{inviter}, claimants...) {
+				mustTransition(t, h.bot.dbm, chat.ID, UserStatus{State: USER_LOBBY})
+			}
+
+			for round := 0; round < CLAIM_TEST_ROUNDS; round++ {
+				topic := fmt.Sprint("话题", round)
+				err := h.bot.dbm.TransitionUser(inviter.ID, USER_LOBBY, UserStatus{State: USER_WAITING, Topic: topic})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var wg sync.WaitGroup
+				for _, chat := range claimants {
+					update := h.newCallbackUpdate(chat, TOPIC_CALLBACK_PREFIX+topic)
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						h.bot.processUpdate(update)
+					}()
+				}
+				wg.Wait()
+
+				expectOneWinner(t, h.bot.dbm, inviter.ID, claimants)
+
+				// Everyone goes back to the lobby for the next round.
+				for _, chat := range append([]*tgbotapi.Chat{inviter}, claimants...) {
+					_, err := h.bot.dbm.KickUser(chat.ID)
+					if err != nil {
+						t.Fatal(err)
+					}
+					mustTransition(t, h.bot.dbm, chat.ID, UserStatus{State: USER_LOBBY})
+				}
+				// A minute at a time, so the rate limits do not slow it down.
+				for !h.bot.queue.Idle() {
+					h.clock.Advance(time.Minute)
+					time.Sleep(time.Millisecond)
+				}
+			}
+		})
+	}
+}
+
+// expectOneWinner checks that exactly one claimant is chatting with the
+// inviter. The others may have started the topic anew, and paired up
+// among themselves, but never with someone else's partner.
+func expectOneWinner(t *testing.T, dbm Storage, inviter int64, claimants []*tgbotapi.Chat) {
+	t.Helper()
+	winner := int64(0)
+	for _, chat := range claimants {
+		status, err := dbm.GetUser(chat.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != USER_CHATTING {
+			continue
+		}
+		partner, err := dbm.GetUser(status.Partner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if partner.State != USER_CHATTING || partner.Partner != chat.ID {
+			t.Fatalf("#%d is chatting with #%d, who is %+v", chat.ID, status.Partner, partner)
+		}
+		if status.Partner == inviter {
+			if winner != 0 {
+				t.Fatalf("both #%d and #%d got the invitation", winner, chat.ID)
+			}
+			winner = chat.ID
+		}
+	}
+	if winner == 0 {
+		t.Fatal("nobody got the invitation")
+	}
+	expectUser(t, dbm, inviter, UserStatus{State: USER_CHATTING, Partner: winner})
+}
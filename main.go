@@ -19,47 +19,118 @@
 package main
 
 import (
-	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	// "gopkg.in/telegram-bot-api.v4"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
-	if DEBUG_MODE {
+	config_path := flag.String("config", DEFAULT_CONFIG_PATH, "path to the configuration file, empty to use only config.go and the environment")
+	migrate_dry_run := flag.Bool("migrate-dry-run", false, "list the database migrations that would be applied and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [command]\n", os.Args[0])
+		flag.PrintDefaults()
+		AdminUsage(flag.CommandLine.Output())
+	}
+	flag.Parse()
+
+	// Without -config, config.json is optional.
+	if !flagGiven("config") {
+		_, err := os.Stat(*config_path)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("%s not found, using the built-in configuration.\n", *config_path)
+			*config_path = ""
+		}
+	}
+
+	conf, err := LoadConfig(*config_path)
+	checkError(err)
+
+	log.Println("Configuration loaded.")
+
+	if conf.Debug {
 		log.Println("The program is running in debug mode,")
 		log.Println("  the time limit will be disabled,")
 		log.Println("  all chat logs will be print.")
 	}
 
-	db, err := sql.Open("sqlite3", "./bot.db")
-	checkError(err)
+	if *migrate_dry_run {
+		printPendingMigrations(conf)
+		return
+	}
 
-	dbm := NewDBManager(db)
+	dbm, err := NewStorage(conf)
+	checkError(err)
 
 	err = dbm.CreateTables()
 	checkError(err)
 
 	log.Println("Database initialized.")
 
-	api, err := tgbotapi.NewBotAPI(SECRET)
+	if flag.NArg() != 0 {
+		err = RunAdminCommand(conf, dbm, os.Stdout, flag.Args())
+		if err != nil {
+			dbm.Close()
+			log.Fatalln(err)
+		}
+		err = dbm.Close()
+		checkError(err)
+		return
+	}
+
+	transport, err := NewTelegramTransport(conf)
 	checkError(err)
 
 	log.Println("Bot API connected.")
 
-	bot, err := NewBot(api, dbm)
+	bot, err := NewBot(conf, NewRealClock(), transport, dbm)
 	checkError(err)
 
 	log.Println("Controller initialized.")
 
-	bot.Run()
+	go bot.Run()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-signals
+	for sig == syscall.SIGHUP {
+		bot.ResetCache()
+		sig = <-signals
+	}
+	signal.Stop(signals)
+	log.Printf("Received %v, shutting down.\n", sig)
+
+	bot.Shutdown(time.Duration(conf.ShutdownTimeout) * time.Second)
+
+	err = dbm.Close()
+	checkError(err)
+
+	log.Println("Database closed.")
 }
 
-func printLog(user *tgbotapi.User, text string, scramble bool) {
-	if !DEBUG_MODE && scramble {
+const DEFAULT_CONFIG_PATH = "config.json"
+
+// flagGiven reports whether the flag was set on the command line.
+func flagGiven(name string) (given bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return
+}
+
+func (bot *Bot) printLog(user *tgbotapi.User, text string, scramble bool) {
+	if !bot.config.Debug && scramble {
 		text = "(scrambled)"
 	}
 	var user_repr string
@@ -74,6 +145,30 @@ func printLog(user *tgbotapi.User, text string, scramble bool) {
 	log.Printf("[%s]: %s\n", user_repr, text)
 }
 
+// printPendingMigrations opens the database read-only, so a dry run
+// changes nothing on disk.
+func printPendingMigrations(conf *Config) {
+	if conf.Storage == STORAGE_MEMORY {
+		log.Println("This storage has no schema to migrate.")
+		return
+	}
+	dbm, err := NewReadOnlyDBManager(conf)
+	checkError(err)
+	defer dbm.Close()
+	version, err := dbm.SchemaVersion()
+	checkError(err)
+	pending, err := dbm.PendingMigrations()
+	checkError(err)
+	log.Printf("Database schema version: %d\n", version)
+	if len(pending) == 0 {
+		log.Println("The database is up to date.")
+		return
+	}
+	for _, m := range pending {
+		log.Printf("Would apply migration %v\n", m)
+	}
+}
+
 func checkError(err error) {
 	if err != nil {
 		log.Fatalln(err)
@@ -0,0 +1,420 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStorage behaves like dbManager, but forgets everything on exit.
+type memoryStorage struct {
+	lock     sync.Mutex
+	admin    map[int64]bool
+	users    map[int64]UserStatus
+	activity map[int64]UserActivity
+	banlist  map[int64]Ban
+	// Received update IDs, true once handled.
+	processed map[int]bool
+}
+
+func NewMemoryStorage() *memoryStorage {
+	s := &memoryStorage{}
+	s.CreateTables()
+	return s
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+func (s *memoryStorage) CreateTables() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.admin == nil {
+		s.admin = make(map[int64]bool)
+		s.users = make(map[int64]UserStatus)
+		s.activity = make(map[int64]UserActivity)
+		s.banlist = make(map[int64]Ban)
+		s.processed = make(map[int]bool)
+	}
+	return nil
+}
+
+func shuffleUsers(users []int64) []int64 {
+	rand.Shuffle(len(users), func(i, j int) {
+		users[i], users[j] = users[j], users[i]
+	})
+	return users
+}
+
+// Updates
+
+func (s *memoryStorage) GetUpdateOffset() (offset int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	unhandled := -1
+	for id, handled := range s.processed {
+		if id+1 > offset {
+			offset = id + 1
+		}
+		if !handled && (unhandled == -1 || id < unhandled) {
+			unhandled = id
+		}
+	}
+	if unhandled != -1 {
+		offset = unhandled
+	}
+	return
+}
+
+func (s *memoryStorage) MarkUpdateReceived(id int) (handled bool, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	handled, ok := s.processed[id]
+	if ok {
+		return
+	}
+	s.processed[id] = false
+	if id%100 == 0 {
+		for old := range s.processed {
+			if old < id-PROCESSED_UPDATE_WINDOW {
+				delete(s.processed, old)
+			}
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) MarkUpdateProcessed(id int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.processed[id]; ok {
+		s.processed[id] = true
+	}
+	return nil
+}
+
+// Users
+
+func (s *memoryStorage) GetUser(user int64) (status UserStatus, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.users[user], nil
+}
+
+func (s *memoryStorage) TransitionUser(user int64, from UserState, to UserStatus) error {
+	err := checkUserTransition(from, to.State)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.users[user].State != from {
+		return ErrStateChanged
+	}
+	s.users[user] = to
+	return nil
+}
+
+func (s *memoryStorage) KickUser(user int64) (partner int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.kickUser(user), nil
+}
+
+// Must be called with s.lock held.
+func (s *memoryStorage) kickUser(user int64) (partner int64) {
+	status, ok := s.users[user]
+	if !ok {
+		return 0
+	}
+	if status.State == USER_CHATTING && status.Partner != 0 {
+		partner = status.Partner
+		s.clearPartner(partner, user)
+	}
+	s.users[user] = UserStatus{State: USER_DISCONNECTED, Room: status.Room}
+	return
+}
+
+// Must be called with s.lock held.
+func (s *memoryStorage) clearPartner(user int64, partner int64) {
+	status := s.users[user]
+	if status.State == USER_CHATTING && status.Partner == partner {
+		status.Partner = 0
+		s.users[user] = status
+	}
+}
+
+// Must be called with s.lock held.
+func (s *memoryStorage) listUsers(filter func(status UserStatus) bool) []int64 {
+	var users []int64
+	for user, status := range s.users {
+		if filter(status) {
+			users = append(users, user)
+		}
+	}
+	return shuffleUsers(users)
+}
+
+func (s *memoryStorage) GetActiveUsers() (chat int, lobby int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, status := range s.users {
+		if status.State == USER_CHATTING {
+			chat++
+		} else if status.State.InLobby() {
+			lobby++
+		}
+	}
+	return
+}
+
+func (s *memoryStorage) ListAllUsers() (users []int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.listUsers(func(status UserStatus) bool {
+		return status.State != USER_DISCONNECTED
+	}), nil
+}
+
+func (s *memoryStorage) RecordActivity(user int64, now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	activity, ok := s.activity[user]
+	if _, known := s.users[user]; !ok && !known {
+		// Like SQL, FirstSeen stays zero for the users known before.
+		activity.FirstSeen = now
+	}
+	if activity.LastActive.Before(now) {
+		activity.LastActive = now
+	}
+	s.activity[user] = activity
+	return nil
+}
+
+func (s *memoryStorage) GetUserActivity(user int64) (activity UserActivity, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.activity[user], nil
+}
+
+func (s *memoryStorage) ExpireIdleUsers(idle_since time.Time) (users []int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for user, status := range s.users {
+		if status.State.InLobby() && s.activity[user].LastActive.Before(idle_since) {
+			s.users[user] = UserStatus{State: USER_DISCONNECTED, Room: status.Room}
+			users = append(users, user)
+		}
+	}
+	return
+}
+
+// Chats
+
+func (s *memoryStorage) LeaveChat(user_a int64) (user_b int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := s.users[user_a]
+	if status.State != USER_CHATTING {
+		return 0, ErrStateChanged
+	}
+	user_b = status.Partner
+	s.users[user_a] = UserStatus{State: USER_LOBBY, Room: 0} // TODO: more lobbies
+	if user_b != 0 {
+		s.clearPartner(user_b, user_a)
+	}
+	return user_b, nil
+}
+
+func (s *memoryStorage) ListUnmatchedUsers() (users []int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.listUsers(func(status UserStatus) bool {
+		return status.State.InLobby() || (status.State == USER_CHATTING && status.Partner == 0)
+	}), nil
+}
+
+// Invitations
+
+// Like SQLite, the inviter with the smallest ID wins.
+func (s *memoryStorage) ClaimInvitation(user_a int64, topic string) (user_b int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for u, status := range s.users {
+		if u != user_a && status.State == USER_WAITING && status.Topic == topic && (user_b == 0 || u < user_b) {
+			user_b = u
+		}
+	}
+	if user_b == 0 {
+		return 0, ErrInvitationTaken
+	}
+	status_a, status_b := s.users[user_a], s.users[user_b]
+	if !status_a.State.InLobby() {
+		return 0, ErrStateChanged
+	}
+	s.users[user_a] = UserStatus{State: USER_CHATTING, Room: status_a.Room, Partner: user_b}
+	s.users[user_b] = UserStatus{State: USER_CHATTING, Room: status_b.Room, Partner: user_a}
+	return user_b, nil
+}
+
+func (s *memoryStorage) ListInvites() (topics []string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, status := range s.users {
+		if status.State == USER_WAITING {
+			topics = append(topics, status.Topic)
+		}
+	}
+	rand.Shuffle(len(topics), func(i, j int) {
+		topics[i], topics[j] = topics[j], topics[i]
+	})
+	return
+}
+
+// Lobbies
+
+func (s *memoryStorage) ListUsersInLobby(room int64) (users []int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.listUsers(func(status UserStatus) bool {
+		return status.State.InLobby() && status.Room == room
+	}), nil
+}
+
+// Administration
+
+func (s *memoryStorage) AddAdmin(user int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.admin[user] = true
+	return nil
+}
+
+func (s *memoryStorage) RemoveAdmin(user int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.admin, user)
+	return nil
+}
+
+func (s *memoryStorage) BanUser(ban Ban) (partner int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ban.Appeal, ban.AppealText = APPEAL_NONE, ""
+	s.banlist[ban.User] = ban
+	return s.kickUser(ban.User), nil
+}
+
+func (s *memoryStorage) RemoveFromBanList(user int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.banlist, user)
+	return nil
+}
+
+// Status
+
+func (s *memoryStorage) ListBans(now time.Time) (bans []Ban, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for user, ban := range s.banlist {
+		if ban.ExpiredAt(now) {
+			delete(s.banlist, user)
+		} else {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].User < bans[j].User
+	})
+	return
+}
+
+func (s *memoryStorage) ListAdmins() (users []int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for user := range s.admin {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i] < users[j]
+	})
+	return
+}
+
+func (s *memoryStorage) IsUserAnAdmin(user int64) (ok bool, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.admin[user], nil
+}
+
+func (s *memoryStorage) GetBan(user int64, now time.Time) (ban *Ban, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b, ok := s.banlist[user]
+	if !ok {
+		return nil, nil
+	}
+	if b.ExpiredAt(now) {
+		delete(s.banlist, user)
+		return nil, nil
+	}
+	return &b, nil
+}
+
+// Must be called with s.lock held.
+func (s *memoryStorage) findAppeal(user int64, created_at time.Time, state AppealState) (ban Ban, ok bool) {
+	ban, ok = s.banlist[user]
+	if !ok || unixOrZero(ban.CreatedAt) != unixOrZero(created_at) || ban.Appeal != state {
+		return Ban{}, false
+	}
+	return ban, true
+}
+
+func (s *memoryStorage) SetAppeal(user int64, created_at time.Time, from AppealState, to AppealState, text string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ban, ok := s.findAppeal(user, created_at, from)
+	if !ok {
+		return ErrStateChanged
+	}
+	ban.Appeal, ban.AppealText = to, text
+	s.banlist[user] = ban
+	return nil
+}
+
+func (s *memoryStorage) ResolveAppeal(user int64, created_at time.Time, approve bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ban, ok := s.findAppeal(user, created_at, APPEAL_PENDING)
+	if !ok {
+		return ErrStateChanged
+	}
+	if approve {
+		delete(s.banlist, user)
+	} else {
+		ban.Appeal = APPEAL_REJECTED
+		s.banlist[user] = ban
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+// Schema migrations live in migrations/<backend>/NNNN_name.sql and are
+// compiled into the binary. Each one runs in its own transaction, together
+// with the row recording it in schema_version. Never edit a migration that
+// has been released; add a new one instead.
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Script  string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Migrator is implemented by the storages that keep a schema.
+type Migrator interface {
+	SchemaVersion() (version int, err error)
+	PendingMigrations() (pending []Migration, err error)
+}
+
+// LoadMigrations reads the migrations of a backend, ordered by version.
+// The versions must count up from 1 without gaps.
+func LoadMigrations(backend string) (migrations []Migration, err error) {
+	dir := path.Join("migrations", backend)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".sql")
+		if !ok {
+			continue
+		}
+		number, name, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: expected NNNN_name.sql", entry.Name())
+		}
+		var version int
+		version, err = strconv.Atoi(number)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %v", entry.Name(), err)
+		}
+		var script []byte
+		script, err = fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return
+		}
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    name,
+			Script:  string(script),
+		})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %v: expected version %d", m, i+1)
+		}
+	}
+	return
+}
+
+// pendingMigrations returns the migrations newer than version, or an error
+// if the database was written by a newer program.
+func pendingMigrations(migrations []Migration, version int) ([]Migration, error) {
+	if version > len(migrations) {
+		return nil, fmt.Errorf("database schema version %d is newer than the latest known version %d, refusing to run", version, len(migrations))
+	}
+	return migrations[version:], nil
+}
@@ -0,0 +1,4 @@
+-- The versions follow the SQLite migrations, so both backends with the same
+-- version have the same tables. There never were chat, lobby or invite tables here.
+CREATE TABLE admin ("user" BIGINT PRIMARY KEY);
+CREATE TABLE banlist ("user" BIGINT PRIMARY KEY);
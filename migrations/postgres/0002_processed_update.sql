@@ -0,0 +1 @@
+CREATE TABLE processed_update (id BIGINT PRIMARY KEY);
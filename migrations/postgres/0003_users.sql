@@ -0,0 +1,3 @@
+-- States: 1 lobby, 2 typing topic, 3 waiting, 4 chatting, see user_state.go.
+CREATE TABLE users ("user" BIGINT PRIMARY KEY, state INTEGER NOT NULL, room BIGINT NOT NULL DEFAULT 0, topic TEXT NOT NULL DEFAULT '', partner BIGINT NOT NULL DEFAULT 0);
+CREATE INDEX users_state ON users (state);
@@ -0,0 +1,6 @@
+-- Times are Unix seconds. An expires_at of 0 means the ban never ends.
+ALTER TABLE banlist
+	ADD COLUMN reason TEXT NOT NULL DEFAULT '',
+	ADD COLUMN admin BIGINT NOT NULL DEFAULT 0,
+	ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0,
+	ADD COLUMN expires_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- Appeal states: 0 none, 1 typing, 2 pending, 3 rejected, see appeal.go.
+ALTER TABLE banlist
+	ADD COLUMN appeal INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN appeal_text TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- Messages waiting in the send queue, see outbox.go.
+CREATE TABLE outbox (id BIGSERIAL PRIMARY KEY, priority INTEGER NOT NULL, kind TEXT NOT NULL, body TEXT NOT NULL);
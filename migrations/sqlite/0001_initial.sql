@@ -0,0 +1,6 @@
+-- The schema before versioning. IF NOT EXISTS lets existing databases adopt it.
+CREATE TABLE IF NOT EXISTS admin (user INTEGER PRIMARY KEY);
+CREATE TABLE IF NOT EXISTS invite (user INTEGER PRIMARY KEY, topic TEXT);
+CREATE TABLE IF NOT EXISTS lobby (user INTEGER PRIMARY KEY, room INTEGER);
+CREATE TABLE IF NOT EXISTS chat (user_a INTEGER PRIMARY KEY, user_b INTEGER);
+CREATE TABLE IF NOT EXISTS banlist (user INTEGER PRIMARY KEY);
@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS processed_update (id INTEGER PRIMARY KEY);
@@ -0,0 +1,13 @@
+-- Move the state from the chat, lobby and invite tables into users.
+-- States: 1 lobby, 2 typing topic, 3 waiting, 4 chatting, see user_state.go.
+CREATE TABLE IF NOT EXISTS users (user INTEGER PRIMARY KEY, state INTEGER NOT NULL, room INTEGER NOT NULL DEFAULT 0, topic TEXT NOT NULL DEFAULT '', partner INTEGER NOT NULL DEFAULT 0);
+CREATE INDEX IF NOT EXISTS users_state ON users (state);
+
+INSERT OR REPLACE INTO users (user, state, room) SELECT user, 1, coalesce(room, 0) FROM lobby;
+UPDATE users SET state = 2 WHERE user IN (SELECT user FROM invite WHERE topic IS NULL);
+UPDATE users SET state = 3, topic = (SELECT topic FROM invite WHERE invite.user = users.user) WHERE user IN (SELECT user FROM invite WHERE topic IS NOT NULL);
+INSERT OR REPLACE INTO users (user, state, partner) SELECT user_a, 4, coalesce(user_b, 0) FROM chat;
+
+DROP TABLE invite;
+DROP TABLE lobby;
+DROP TABLE chat;
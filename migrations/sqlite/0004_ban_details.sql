@@ -0,0 +1,5 @@
+-- Times are Unix seconds. An expires_at of 0 means the ban never ends.
+ALTER TABLE banlist ADD COLUMN reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE banlist ADD COLUMN admin INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE banlist ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE banlist ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+-- Unix seconds, first_seen is 0 for the users from before it was recorded.
+ALTER TABLE users ADD COLUMN first_seen BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN last_active BIGINT NOT NULL DEFAULT 0;
+-- Do not expire everyone at once.
+UPDATE users SET last_active = CAST(strftime('%s', 'now') AS INTEGER);
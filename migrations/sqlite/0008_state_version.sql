@@ -0,0 +1,4 @@
+-- Changed whenever the users are changed behind the bot's back,
+-- so its cache knows to read them again, see state_cache.go.
+CREATE TABLE state_version (version INTEGER NOT NULL);
+INSERT INTO state_version VALUES (0);
@@ -0,0 +1,3 @@
+-- 0 from when an update is received until it has been handled, so an
+-- update still queued when the bot stops is asked for again.
+ALTER TABLE processed_update ADD COLUMN handled INTEGER NOT NULL DEFAULT 1;
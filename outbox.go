@@ -0,0 +1,106 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+// With Config.Outbox, every message in the send queue is also written to
+// the outbox table, and removed once it has been sent. Whatever is left on
+// exit, or after a crash, is sent on the next start, so a message may be
+// sent twice but is not lost. The callbacks are not kept.
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// OutboxEntry is one row in the outbox table.
+type OutboxEntry struct {
+	ID       int64
+	Priority int
+	// The type of the message, like MessageConfig.
+	Kind string
+	// The message encoded in JSON.
+	Body string
+}
+
+// Outbox is implemented by the storages that can keep the send queue.
+type Outbox interface {
+	AddToOutbox(entries []OutboxEntry) error
+	RemoveFromOutbox(id int64) error
+	ListOutbox() (entries []OutboxEntry, err error)
+}
+
+// The messages the bot sends, which are all made of plain values.
+// Uploading a new file is not among them, only sharing one by its ID.
+var outboxKinds = make(map[string]reflect.Type)
+
+func init() {
+	for _, c := range []tgbotapi.Chattable{
+		tgbotapi.MessageConfig{},
+		tgbotapi.ForwardConfig{},
+		tgbotapi.PhotoConfig{},
+		tgbotapi.AudioConfig{},
+		tgbotapi.DocumentConfig{},
+		tgbotapi.StickerConfig{},
+		tgbotapi.VideoConfig{},
+		tgbotapi.VideoNoteConfig{},
+		tgbotapi.VoiceConfig{},
+		tgbotapi.LocationConfig{},
+		tgbotapi.VenueConfig{},
+		tgbotapi.ContactConfig{},
+	} {
+		t := reflect.TypeOf(c)
+		outboxKinds[t.Name()] = t
+	}
+}
+
+func encodeOutboxEntry(priority int, c tgbotapi.Chattable) (entry OutboxEntry, err error) {
+	t := reflect.TypeOf(c)
+	if outboxKinds[t.Name()] != t {
+		err = fmt.Errorf("outbox: cannot store %v", t)
+		return
+	}
+	body, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	entry = OutboxEntry{
+		Priority: priority,
+		Kind:     t.Name(),
+		Body:     string(body),
+	}
+	return
+}
+
+// decodeOutboxEntry turns the entry back into a message.
+// A reply markup comes back as a map, which encodes the same way.
+func decodeOutboxEntry(entry OutboxEntry) (c tgbotapi.Chattable, err error) {
+	t, ok := outboxKinds[entry.Kind]
+	if !ok {
+		return nil, fmt.Errorf("outbox: unknown message type %q", entry.Kind)
+	}
+	v := reflect.New(t)
+	err = json.Unmarshal([]byte(entry.Body), v.Interface())
+	if err != nil {
+		return
+	}
+	return v.Elem().Interface().(tgbotapi.Chattable), nil
+}
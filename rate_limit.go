@@ -0,0 +1,106 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Telegram allows about 30 messages per second in total, and about one
+// per second to each chat, with short bursts tolerated.
+type RateLimitConfig struct {
+	// Messages per second, and how many may go out at once after a pause.
+	Global      float64 `json:"global"`
+	GlobalBurst int     `json:"global_burst"`
+	// The same for each chat.
+	PerChat      float64 `json:"per_chat"`
+	PerChatBurst int     `json:"per_chat_burst"`
+}
+
+func (conf *RateLimitConfig) Validate() error {
+	if conf.Global <= 0 {
+		return fmt.Errorf("config: rate_limit global must be positive: %v", conf.Global)
+	}
+	if conf.GlobalBurst < 1 {
+		return fmt.Errorf("config: rate_limit global_burst must be at least 1: %d", conf.GlobalBurst)
+	}
+	if conf.PerChat <= 0 {
+		return fmt.Errorf("config: rate_limit per_chat must be positive: %v", conf.PerChat)
+	}
+	if conf.PerChatBurst < 1 {
+		return fmt.Errorf("config: rate_limit per_chat_burst must be at least 1: %d", conf.PerChatBurst)
+	}
+	return nil
+}
+
+// tokenBucket allows rate messages per second on average, and up to burst
+// at once. It starts full.
+type tokenBucket struct {
+	rate    float64
+	burst   float64
+	tokens  float64
+	updated time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:    rate,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		updated: now,
+	}
+}
+
+func (b *tokenBucket) fill(now time.Time) {
+	if now.After(b.updated) {
+		b.tokens += now.Sub(b.updated).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.updated = now
+	} else if now.Before(b.updated) {
+		// The clock was set back.
+		b.updated = now
+	}
+}
+
+// ready returns when a message may be sent, now if it already may.
+func (b *tokenBucket) ready(now time.Time) time.Time {
+	b.fill(now)
+	if b.tokens >= 1 {
+		return now
+	}
+	// Rounded up, or we would wake up just too early.
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	return now.Add(wait + 1)
+}
+
+// take spends a token. It may go into debt if the bucket was not ready.
+func (b *tokenBucket) take(now time.Time) {
+	b.fill(now)
+	b.tokens--
+}
+
+// full reports whether the bucket has refilled completely,
+// so forgetting it changes nothing.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.fill(now)
+	return b.tokens >= b.burst
+}
@@ -0,0 +1,264 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2017, 1, 1, 22, 0, 0, 0, time.UTC)
+	b := newTokenBucket(2, 3, start)
+
+	// A full burst at once, then one every half a second.
+	for i := 0; i < 3; i++ {
+		if ready := b.ready(start); !ready.Equal(start) {
+			t.Fatalf("message %d not ready until %v", i, ready.Sub(start))
+		}
+		b.take(start)
+	}
+	ready := b.ready(start)
+	if ready.Sub(start) < 500*time.Millisecond || ready.Sub(start) > 501*time.Millisecond {
+		t.Fatalf("next message ready after %v", ready.Sub(start))
+	}
+	if b.full(start) {
+		t.Fatal("empty bucket is full")
+	}
+	b.take(ready)
+	if next := b.ready(ready); next.Sub(ready) < 500*time.Millisecond || next.Sub(ready) > 501*time.Millisecond {
+		t.Fatalf("next message ready after %v", next.Sub(ready))
+	}
+
+	// However long it waits, it holds no more than a burst.
+	later := start.Add(time.Hour)
+	if !b.full(later) {
+		t.Fatal("bucket not full after an hour")
+	}
+	for i := 0; i < 3; i++ {
+		if !b.ready(later).Equal(later) {
+			t.Fatalf("message %d of the burst not ready", i)
+		}
+		b.take(later)
+	}
+	if b.ready(later).Equal(later) {
+		t.Fatal("more than a burst is ready")
+	}
+
+	// Setting the clock back does not add tokens.
+	if b.ready(start).Equal(start) {
+		t.Fatal("ready after the clock went back")
+	}
+}
+
+// timedTransport records when each message was tried.
+type timedTransport struct {
+	*fakeTransport
+	clock *fakeClock
+
+	lock  sync.Mutex
+	tries []timedSend
+}
+
+type timedSend struct {
+	chat int64
+	at   time.Time
+	err  error
+}
+
+func (t *timedTransport) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	at := t.clock.Now()
+	msg, err := t.fakeTransport.Send(c)
+	chat, _ := recipientOf(c)
+	t.lock.Lock()
+	t.tries = append(t.tries, timedSend{chat, at, err})
+	t.lock.Unlock()
+	return msg, err
+}
+
+// Each step of the fake clock while sending.
+const RATE_TEST_STEP = 10 * time.Millisecond
+
+func newRateTestQueue(t *testing.T, limits *RateLimitConfig) (q *sendQueue, transport *timedTransport, clock *fakeClock) {
+	clock = NewFakeClock(time.Date(2017, 1, 1, 22, 0, 0, 0, time.UTC))
+	transport = &timedTransport{fakeTransport: NewFakeTransport(), clock: clock}
+	q, err := NewSendQueue(clock, transport, NewMemoryStorage(), nil, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Shutdown(time.Now()) })
+	return
+}
+
+// drainRateTestQueue moves the clock along until everything is sent.
+func drainRateTestQueue(t *testing.T, q *sendQueue, clock *fakeClock) {
+	deadline := time.Now().Add(SCENARIO_SETTLE_TIMEOUT)
+	for !q.Idle() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the send queue")
+		}
+		clock.Advance(RATE_TEST_STEP)
+		time.Sleep(50 * time.Microsecond)
+	}
+}
+
+func messagesTo(chats ...int64) (msgs []tgbotapi.Chattable) {
+	for _, chat := range chats {
+		msgs = append(msgs, tgbotapi.NewMessage(chat, "你好"))
+	}
+	return
+}
+
+// expectPaced checks that the nth try was not made before
+// start + (n - burst + 1) / rate, and the last one not much later.
+func expectPaced(t *testing.T, tries []timedSend, start time.Time, rate float64, burst int) {
+	t.Helper()
+	var earliest time.Duration
+	for n, try := range tries {
+		if n >= burst {
+			earliest = time.Duration(float64(n-burst+1) / rate * float64(time.Second))
+		}
+		if got := try.at.Sub(start); got < earliest {
+			t.Fatalf("message %d sent after %v, expected %v", n, got, earliest)
+		}
+	}
+	// The clock may run ahead of the queue now and then.
+	if got := tries[len(tries)-1].at.Sub(start); got > earliest+20*RATE_TEST_STEP {
+		t.Fatalf("the last message sent after %v, expected %v", got, earliest)
+	}
+}
+
+func TestSendQueueGlobalRate(t *testing.T) {
+	limits := &RateLimitConfig{Global: 30, GlobalBurst: 30, PerChat: 1, PerChatBurst: 3}
+	q, transport, clock := newRateTestQueue(t, limits)
+	start := clock.Now()
+
+	var chats []int64
+	for chat := int64(1); chat <= 120; chat++ {
+		chats = append(chats, chat)
+	}
+	q.Send(QUEUE_PRIORITY_NORMAL, messagesTo(chats...), nil)
+	drainRateTestQueue(t, q, clock)
+
+	if len(transport.tries) != 120 {
+		t.Fatalf("sent %d messages", len(transport.tries))
+	}
+	expectPaced(t, transport.tries, start, limits.Global, limits.GlobalBurst)
+}
+
+func TestSendQueueChatRate(t *testing.T) {
+	limits := &RateLimitConfig{Global: 30, GlobalBurst: 30, PerChat: 1, PerChatBurst: 3}
+	q, transport, clock := newRateTestQueue(t, limits)
+	start := clock.Now()
+
+	q.Send(QUEUE_PRIORITY_NORMAL, messagesTo(1, 1, 1, 1, 1, 1, 1, 1, 2), nil)
+	drainRateTestQueue(t, q, clock)
+
+	var to_1, to_2 []timedSend
+	for _, try := range transport.tries {
+		if try.chat == 1 {
+			to_1 = append(to_1, try)
+		} else {
+			to_2 = append(to_2, try)
+		}
+	}
+	if len(to_1) != 8 || len(to_2) != 1 {
+		t.Fatalf("sent %d and %d messages", len(to_1), len(to_2))
+	}
+	expectPaced(t, to_1, start, limits.PerChat, limits.PerChatBurst)
+	// Not held back by the other chat.
+	expectPaced(t, to_2, start, limits.PerChat, limits.PerChatBurst)
+}
+
+// Flood control on a chat not sent to just now is the limit of the bot,
+// so nothing at all is sent until it is over.
+func TestSendQueueGlobalPause(t *testing.T) {
+	// One at a time, so some are still waiting when the limit is hit.
+	q, transport, clock := newRateTestQueue(t, &RateLimitConfig{Global: 30, GlobalBurst: 1, PerChat: 1, PerChatBurst: 3})
+	transport.FailNext(5, scenarioSendErrors["flood"])
+
+	var errs []error
+	q.Send(QUEUE_PRIORITY_NORMAL, messagesTo(1, 2, 3, 4, 5, 6, 7, 8, 9, 10), func(msg_result []*tgbotapi.Message, msg_errors []error) {
+		errs = msg_errors
+	})
+	drainRateTestQueue(t, q, clock)
+
+	var failed_at time.Time
+	for _, try := range transport.tries {
+		if try.err != nil {
+			failed_at = try.at
+		}
+	}
+	if failed_at.IsZero() {
+		t.Fatal("the failure was not injected")
+	}
+	waited := 0
+	for _, try := range transport.tries {
+		if try.at.After(failed_at) {
+			if try.at.Sub(failed_at) < 3*time.Second {
+				t.Fatalf("sent to #%d %v after flood control", try.chat, try.at.Sub(failed_at))
+			}
+			waited++
+		}
+	}
+	// The one that failed, and the five after it.
+	if waited != 6 {
+		t.Fatalf("%d messages waited", waited)
+	}
+	if len(transport.tries) != 11 {
+		t.Fatalf("tried %d times", len(transport.tries))
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("message %d failed: %v", i, err)
+		}
+	}
+}
+
+// Flood control right after another message to the chat only pauses it.
+func TestSendQueueChatPause(t *testing.T) {
+	q, transport, clock := newRateTestQueue(t, &RateLimitConfig{Global: 30, GlobalBurst: 1, PerChat: 1, PerChatBurst: 3})
+	q.Send(QUEUE_PRIORITY_NORMAL, messagesTo(1), nil)
+	drainRateTestQueue(t, q, clock)
+	transport.FailNext(1, scenarioSendErrors["flood"])
+	q.Send(QUEUE_PRIORITY_NORMAL, messagesTo(1, 2), nil)
+	drainRateTestQueue(t, q, clock)
+
+	var failed_at, resent_at, other_at time.Time
+	for _, try := range transport.tries {
+		switch {
+		case try.err != nil:
+			failed_at = try.at
+		case try.chat == 2:
+			other_at = try.at
+		case !failed_at.IsZero():
+			// The retry; the first message came before the failure.
+			resent_at = try.at
+		}
+	}
+	if failed_at.IsZero() || resent_at.Sub(failed_at) < 3*time.Second {
+		t.Fatalf("failed at %v, sent again at %v", failed_at, resent_at)
+	}
+	if !other_at.After(failed_at) || other_at.Sub(failed_at) >= 3*time.Second {
+		t.Fatalf("the other chat waited %v", other_at.Sub(failed_at))
+	}
+}
@@ -0,0 +1,334 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+// How far ahead NextOpen looks before giving up.
+const SCHEDULE_LOOKAHEAD_DAYS = 400
+
+type Schedule struct {
+	location      *time.Location
+	location_name string
+	always_open   bool
+	weekdays      [7][]scheduleWindow
+	holidays      map[string]scheduleHoliday
+}
+
+// A window starts and ends at minutes since local midnight.
+// If it crosses midnight, end is greater than 24 hours.
+type scheduleWindow struct {
+	start int
+	end   int
+}
+
+type scheduleHoliday struct {
+	name    string
+	windows []scheduleWindow
+}
+
+type scheduleConfig struct {
+	Timezone     string                  `json:"timezone"`
+	TimezoneName string                  `json:"timezone_name"`
+	AlwaysOpen   bool                    `json:"always_open"`
+	Default      []string                `json:"default"`
+	Weekdays     map[string][]string     `json:"weekdays"`
+	Holidays     []scheduleHolidayConfig `json:"holidays"`
+}
+
+type scheduleHolidayConfig struct {
+	Date    string   `json:"date"`
+	Name    string   `json:"name"`
+	Windows []string `json:"windows"`
+}
+
+func NewDefaultSchedule() *Schedule {
+	s, err := newSchedule(&scheduleConfig{
+		Timezone:     "Asia/Shanghai",
+		TimezoneName: "北京时间",
+		Default:      []string{"21:00-06:00"},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (s *Schedule) UnmarshalJSON(data []byte) error {
+	var conf scheduleConfig
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&conf)
+	if err != nil {
+		return err
+	}
+	parsed, err := newSchedule(&conf)
+	if err != nil {
+		return err
+	}
+	*s = *parsed
+	return nil
+}
+
+func newSchedule(conf *scheduleConfig) (s *Schedule, err error) {
+	s = &Schedule{
+		location:      time.UTC,
+		location_name: conf.TimezoneName,
+		always_open:   conf.AlwaysOpen,
+		holidays:      make(map[string]scheduleHoliday),
+	}
+	if conf.Timezone != "" {
+		s.location, err = time.LoadLocation(conf.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: %v", err)
+		}
+	}
+	if s.location_name == "" {
+		s.location_name = s.location.String()
+	}
+
+	default_windows, err := parseScheduleWindows(conf.Default)
+	if err != nil {
+		return nil, err
+	}
+	for i := range s.weekdays {
+		s.weekdays[i] = default_windows
+	}
+	for name, windows := range conf.Weekdays {
+		weekday, ok := parseWeekday(name)
+		if !ok {
+			return nil, fmt.Errorf("schedule: unknown weekday %q", name)
+		}
+		s.weekdays[weekday], err = parseScheduleWindows(windows)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, holiday := range conf.Holidays {
+		date, err := time.ParseInLocation("2006-01-02", holiday.Date, s.location)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: invalid holiday date %q", holiday.Date)
+		}
+		windows, err := parseScheduleWindows(holiday.Windows)
+		if err != nil {
+			return nil, err
+		}
+		s.holidays[date.Format("2006-01-02")] = scheduleHoliday{
+			name:    holiday.Name,
+			windows: windows,
+		}
+	}
+
+	if !s.always_open {
+		has_windows := len(s.holidays) != 0
+		for i := range s.weekdays {
+			if len(s.weekdays[i]) != 0 {
+				has_windows = true
+			}
+		}
+		if !has_windows {
+			return nil, fmt.Errorf("schedule: no open windows, set always_open if intended")
+		}
+	}
+	return s, nil
+}
+
+func parseWeekday(name string) (time.Weekday, bool) {
+	for i := time.Sunday; i <= time.Saturday; i++ {
+		full := strings.ToLower(i.String())
+		if strings.ToLower(name) == full || strings.ToLower(name) == full[:3] {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Windows are written as "21:00-06:00". An end not later than the start
+// means the window crosses midnight into the next day.
+func parseScheduleWindows(specs []string) (windows []scheduleWindow, err error) {
+	windows = make([]scheduleWindow, 0, len(specs))
+	for _, spec := range specs {
+		parts := strings.Split(spec, "-")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("schedule: invalid window %q", spec)
+		}
+		start, ok1 := parseClock(parts[0])
+		end, ok2 := parseClock(parts[1])
+		if !ok1 || !ok2 || start == 24*60 {
+			return nil, fmt.Errorf("schedule: invalid window %q", spec)
+		}
+		if end <= start {
+			end += 24 * 60
+		}
+		windows = append(windows, scheduleWindow{start: start, end: end})
+	}
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].start < windows[j].start
+	})
+	return windows, nil
+}
+
+func parseClock(clock string) (minutes int, ok bool) {
+	var hour, minute int
+	_, err := fmt.Sscanf(strings.TrimSpace(clock), "%d:%d", &hour, &minute)
+	if err != nil || hour < 0 || minute < 0 || minute >= 60 || hour*60+minute > 24*60 {
+		return 0, false
+	}
+	return hour*60 + minute, true
+}
+
+func (s *Schedule) windowsOn(year int, month time.Month, day int) (windows []scheduleWindow, holiday *scheduleHoliday) {
+	date := time.Date(year, month, day, 0, 0, 0, 0, s.location)
+	if h, ok := s.holidays[date.Format("2006-01-02")]; ok {
+		return h.windows, &h
+	}
+	return s.weekdays[date.Weekday()], nil
+}
+
+func (s *Schedule) windowBounds(year int, month time.Month, day int, w scheduleWindow) (start time.Time, end time.Time) {
+	start = s.wallClock(year, month, day, w.start)
+	end = s.wallClock(year, month, day, w.end)
+	return
+}
+
+// wallClock returns the time the clocks show minutes since midnight.
+// A time skipped when the clocks go forward is taken as that long after
+// the jump, as time.Date may pick the earlier offset and land before it.
+func (s *Schedule) wallClock(year int, month time.Month, day int, minutes int) time.Time {
+	t := time.Date(year, month, day, 0, minutes, 0, 0, s.location)
+	want := time.Date(year, month, day, 0, minutes, 0, 0, time.UTC)
+	local := t.In(s.location)
+	got := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), 0, 0, time.UTC)
+	if skipped := want.Sub(got); skipped > 0 {
+		t = t.Add(skipped)
+	}
+	return t
+}
+
+func (s *Schedule) IsOpen(t time.Time) bool {
+	if s.always_open {
+		return true
+	}
+	local := t.In(s.location)
+	year, month, day := local.Date()
+	// Yesterday's windows may cross midnight into today.
+	for offset := -1; offset <= 0; offset++ {
+		windows, _ := s.windowsOn(year, month, day+offset)
+		for _, w := range windows {
+			start, end := s.windowBounds(year, month, day+offset, w)
+			if !t.Before(start) && t.Before(end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NextOpen returns the next time the schedule opens after t.
+// The second return value is false if it will not open in the foreseeable future.
+func (s *Schedule) NextOpen(t time.Time) (time.Time, bool) {
+	if s.always_open {
+		return t, true
+	}
+	local := t.In(s.location)
+	year, month, day := local.Date()
+	for offset := 0; offset <= SCHEDULE_LOOKAHEAD_DAYS; offset++ {
+		windows, _ := s.windowsOn(year, month, day+offset)
+		for _, w := range windows {
+			start, _ := s.windowBounds(year, month, day+offset, w)
+			if start.After(t) {
+				return start, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// FormatClock formats t as a wall clock time in the schedule's timezone.
+func (s *Schedule) FormatClock(t time.Time) string {
+	local := t.In(s.location)
+	return fmt.Sprintf("%s %d:%02d", s.location_name, local.Hour(), local.Minute())
+}
+
+// FormatTime shows the date as well, e.g. "北京时间 2026年10月20日 21:00".
+func (s *Schedule) FormatTime(t time.Time) string {
+	local := t.In(s.location)
+	return fmt.Sprintf("%s %d年%d月%d日 %d:%02d", s.location_name, local.Year(), int(local.Month()), local.Day(), local.Hour(), local.Minute())
+}
+
+func (s *Schedule) ClosedMessage(t time.Time) string {
+	local := t.In(s.location)
+	year, month, day := local.Date()
+	windows, holiday := s.windowsOn(year, month, day)
+
+	text := "世界树大厅功能当前未开放。\n"
+	if holiday != nil && holiday.name != "" {
+		text += "今天是" + holiday.name + "，"
+	} else {
+		text += "今天"
+	}
+	if len(windows) == 0 {
+		text += "全天不开放。\n"
+	} else {
+		parts := make([]string, len(windows))
+		for i, w := range windows {
+			parts[i] = formatScheduleWindow(w)
+		}
+		text += fmt.Sprintf("开放时间（%s）：%s。\n", s.location_name, strings.Join(parts, "、"))
+	}
+
+	next, ok := s.NextOpen(t)
+	if ok {
+		text += "距离下次开放还有 " + formatScheduleDuration(next.Sub(t)) + "。"
+	} else {
+		text += "近期没有开放的安排。"
+	}
+	return text
+}
+
+func formatScheduleWindow(w scheduleWindow) string {
+	if w.start == 0 && w.end == 24*60 {
+		return "全天"
+	}
+	start := fmt.Sprintf("%d:%02d", w.start/60, w.start%60)
+	if w.end > 24*60 {
+		end := w.end - 24*60
+		return fmt.Sprintf("%s 至次日 %d:%02d", start, end/60, end%60)
+	}
+	return fmt.Sprintf("%s 至 %d:%02d", start, w.end/60, w.end%60)
+}
+
+func formatScheduleDuration(d time.Duration) string {
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	if minutes < 60 {
+		return fmt.Sprintf("%d 分钟", minutes)
+	}
+	if minutes%60 == 0 {
+		return fmt.Sprintf("%d 小时", minutes/60)
+	}
+	return fmt.Sprintf("%d 小时 %d 分钟", minutes/60, minutes%60)
+}
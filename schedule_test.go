@@ -0,0 +1,223 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The schedule of config.json.example, minus Sundays.
+const TEST_SCHEDULE = `{
+	"timezone": "Asia/Shanghai",
+	"timezone_name": "北京时间",
+	"default": ["21:00-06:00"],
+	"weekdays": {
+		"friday": ["20:00-07:00"],
+		"saturday": ["20:00-07:00"],
+		"sunday": []
+	},
+	"holidays": [
+		{"date": "2026-12-31", "name": "跨年夜", "windows": ["18:00-08:00"]},
+		{"date": "2027-02-05", "name": "除夕", "windows": []}
+	]
+}`
+
+func mustSchedule(t *testing.T, config string) *Schedule {
+	t.Helper()
+	s := new(Schedule)
+	err := s.UnmarshalJSON([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func mustParseTime(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestScheduleIsOpen(t *testing.T) {
+	s := mustSchedule(t, TEST_SCHEDULE)
+	clock := NewFakeClock(time.Time{})
+	tests := []struct {
+		at   string
+		open bool
+	}{
+		// 2026-10-19 is a Monday.
+		{"2026-10-19T20:59:00+08:00", false},
+		{"2026-10-19T21:00:00+08:00", true},
+		{"2026-10-19T23:59:00+08:00", true},
+		// Past midnight, still in Monday's window.
+		{"2026-10-20T05:59:00+08:00", true},
+		{"2026-10-20T06:00:00+08:00", false},
+		// The same moments in other timezones.
+		{"2026-10-19T13:30:00Z", true},
+		{"2026-10-19T12:30:00Z", false},
+		{"2026-10-19T06:30:00-07:00", true},
+		// Fridays open earlier, and their window runs into Saturday.
+		{"2026-10-22T20:30:00+08:00", false},
+		{"2026-10-23T20:30:00+08:00", true},
+		{"2026-10-24T06:30:00+08:00", true},
+		{"2026-10-24T07:00:00+08:00", false},
+		// Saturday's window runs into Sunday, which has none.
+		{"2026-10-25T06:59:00+08:00", true},
+		{"2026-10-25T21:30:00+08:00", false},
+		{"2026-10-26T02:00:00+08:00", false},
+		// A holiday with its own window, across midnight.
+		{"2026-12-31T18:30:00+08:00", true},
+		{"2027-01-01T07:30:00+08:00", true},
+		{"2027-01-01T08:00:00+08:00", false},
+		// A holiday closed all day, after Thursday's window ends.
+		{"2027-02-05T05:00:00+08:00", true},
+		{"2027-02-05T22:00:00+08:00", false},
+	}
+	for _, test := range tests {
+		clock.Set(mustParseTime(t, test.at))
+		if open := s.IsOpen(clock.Now()); open != test.open {
+			t.Errorf("%s: open = %v, want %v", test.at, open, test.open)
+		}
+	}
+}
+
+func TestScheduleNextOpen(t *testing.T) {
+	shanghai := mustSchedule(t, TEST_SCHEDULE)
+	mondays := mustSchedule(t, `{"timezone": "Asia/Shanghai", "default": [], "weekdays": {"monday": ["21:00-06:00"]}}`)
+	new_york := mustSchedule(t, `{"timezone": "America/New_York", "default": ["21:00-06:00"]}`)
+	early := mustSchedule(t, `{"timezone": "America/New_York", "default": ["02:30-04:00"]}`)
+	clock := NewFakeClock(time.Time{})
+	tests := []struct {
+		name string
+		s    *Schedule
+		at   string
+		next string
+	}{
+		{"later today", shanghai, "2026-10-19T10:00:00+08:00", "2026-10-19T21:00:00+08:00"},
+		{"open now", shanghai, "2026-10-19T21:00:00+08:00", "2026-10-20T21:00:00+08:00"},
+		{"weekday rule", shanghai, "2026-10-24T10:00:00+08:00", "2026-10-24T20:00:00+08:00"},
+		{"from Sunday to Monday", shanghai, "2026-10-25T10:00:00+08:00", "2026-10-26T21:00:00+08:00"},
+		{"over a holiday", shanghai, "2027-02-04T22:00:00+08:00", "2027-02-06T20:00:00+08:00"},
+		{"into next week", mondays, "2026-10-20T10:00:00+08:00", "2026-10-26T21:00:00+08:00"},
+		{"from UTC", mondays, "2026-10-26T12:00:00Z", "2026-10-26T21:00:00+08:00"},
+		// Clocks go forward at 2:00 on 2026-03-08, and back at 2:00 on 2026-11-01.
+		{"before spring forward", new_york, "2026-03-07T12:00:00-05:00", "2026-03-07T21:00:00-05:00"},
+		{"after spring forward", new_york, "2026-03-08T12:00:00-04:00", "2026-03-08T21:00:00-04:00"},
+		{"after fall back", new_york, "2026-11-01T10:00:00-05:00", "2026-11-01T21:00:00-05:00"},
+		{"skipped hour", early, "2026-03-08T00:00:00-05:00", "2026-03-08T03:30:00-04:00"},
+	}
+	for _, test := range tests {
+		clock.Set(mustParseTime(t, test.at))
+		next, ok := test.s.NextOpen(clock.Now())
+		if want := mustParseTime(t, test.next); !ok || !next.Equal(want) {
+			t.Errorf("%s: next open %v, %v, want %v", test.name, next, ok, want)
+		}
+	}
+
+	// The window across the night is shorter by the hour skipped.
+	clock.Set(mustParseTime(t, "2026-03-08T05:30:00-04:00"))
+	if !new_york.IsOpen(clock.Now()) {
+		t.Error("closed before the window ends")
+	}
+	clock.Set(mustParseTime(t, "2026-03-08T06:00:00-04:00"))
+	if new_york.IsOpen(clock.Now()) {
+		t.Error("open after the window ends")
+	}
+
+	never := mustSchedule(t, `{"default": [], "holidays": [{"date": "2020-01-01", "windows": ["00:00-24:00"]}]}`)
+	if next, ok := never.NextOpen(clock.Now()); ok {
+		t.Errorf("a schedule with no future windows opens at %v", next)
+	}
+}
+
+func TestScheduleAlwaysOpen(t *testing.T) {
+	s := mustSchedule(t, `{"always_open": true}`)
+	clock := NewFakeClock(mustParseTime(t, "2027-02-05T10:00:00+08:00"))
+	for i := 0; i < 7*24; i++ {
+		if !s.IsOpen(clock.Now()) {
+			t.Fatalf("closed at %v", clock.Now())
+		}
+		if next, ok := s.NextOpen(clock.Now()); !ok || !next.Equal(clock.Now()) {
+			t.Fatalf("next open at %v, %v", next, ok)
+		}
+		clock.Advance(time.Hour)
+	}
+}
+
+// Walking through a week, NextOpen always points at the next time
+// IsOpen turns true.
+func TestScheduleWeek(t *testing.T) {
+	s := mustSchedule(t, TEST_SCHEDULE)
+	const step = 10 * time.Minute
+	clock := NewFakeClock(mustParseTime(t, "2026-10-18T00:05:00+08:00"))
+	end := clock.Now().Add(8 * 24 * time.Hour)
+	var closed_since time.Time
+	var expected time.Time
+	for clock.Now().Before(end) {
+		now := clock.Now()
+		switch open := s.IsOpen(now); {
+		case !open && closed_since.IsZero():
+			closed_since = now
+			var ok bool
+			expected, ok = s.NextOpen(now)
+			if !ok {
+				t.Fatalf("%v: never opens", now)
+			}
+		case open && !closed_since.IsZero():
+			if expected.After(now) || now.Sub(expected) >= step {
+				t.Fatalf("closed at %v, opened by %v, NextOpen said %v", closed_since, now, expected)
+			}
+			closed_since = time.Time{}
+		}
+		clock.Advance(step)
+	}
+}
+
+func TestScheduleClosedMessage(t *testing.T) {
+	s := mustSchedule(t, TEST_SCHEDULE)
+	never := mustSchedule(t, `{"timezone_name": "UTC", "default": [], "holidays": [{"date": "2020-01-01", "windows": ["00:00-24:00"]}]}`)
+	clock := NewFakeClock(time.Time{})
+	tests := []struct {
+		s    *Schedule
+		at   string
+		want []string
+	}{
+		{s, "2026-10-19T10:00:00+08:00", []string{"今天开放时间（北京时间）：21:00 至次日 6:00。", "距离下次开放还有 11 小时。"}},
+		{s, "2026-10-19T20:30:30+08:00", []string{"距离下次开放还有 30 分钟。"}},
+		{s, "2026-10-24T10:00:00+08:00", []string{"20:00 至次日 7:00", "距离下次开放还有 10 小时。"}},
+		{s, "2026-12-31T10:00:00+08:00", []string{"今天是跨年夜，开放时间（北京时间）：18:00 至次日 8:00。", "距离下次开放还有 8 小时。"}},
+		{s, "2027-02-05T10:00:00+08:00", []string{"今天是除夕，全天不开放。", "距离下次开放还有 34 小时。"}},
+		{s, "2026-10-25T10:00:00+08:00", []string{"今天全天不开放。", "距离下次开放还有 35 小时。"}},
+		{never, "2026-10-19T10:00:00Z", []string{"今天全天不开放。", "近期没有开放的安排。"}},
+	}
+	for _, test := range tests {
+		clock.Set(mustParseTime(t, test.at))
+		text := test.s.ClosedMessage(clock.Now())
+		for _, want := range test.want {
+			if !strings.Contains(text, want) {
+				t.Errorf("%s: %q does not say %q", test.at, text, want)
+			}
+		}
+	}
+}
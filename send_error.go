@@ -0,0 +1,157 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// SendErrorClass is why Telegram did not take a message.
+type SendErrorClass int
+
+const (
+	// An answer we do not know what to make of.
+	SEND_ERROR_OTHER SendErrorClass = iota
+	// No answer, the connection failed on the way.
+	SEND_ERROR_NETWORK
+	// Telegram itself is having trouble, or a proxy answered for it.
+	SEND_ERROR_SERVER
+	// Too many messages, try again after a while.
+	SEND_ERROR_FLOOD
+	// The message is wrong, sending it again will not help.
+	SEND_ERROR_BAD_REQUEST
+	// The user has blocked the bot.
+	SEND_ERROR_BLOCKED
+	// The user has deleted their account.
+	SEND_ERROR_DEACTIVATED
+	// The chat is gone, or never talked to the bot.
+	SEND_ERROR_CHAT_NOT_FOUND
+	// The bot was removed from the group.
+	SEND_ERROR_KICKED
+	// Any other reason the bot may not write to the chat.
+	SEND_ERROR_FORBIDDEN
+)
+
+func (class SendErrorClass) String() string {
+	switch class {
+	case SEND_ERROR_OTHER:
+		return "other"
+	case SEND_ERROR_NETWORK:
+		return "network"
+	case SEND_ERROR_SERVER:
+		return "server"
+	case SEND_ERROR_FLOOD:
+		return "flood"
+	case SEND_ERROR_BAD_REQUEST:
+		return "bad request"
+	case SEND_ERROR_BLOCKED:
+		return "blocked"
+	case SEND_ERROR_DEACTIVATED:
+		return "deactivated"
+	case SEND_ERROR_CHAT_NOT_FOUND:
+		return "chat not found"
+	case SEND_ERROR_KICKED:
+		return "kicked"
+	case SEND_ERROR_FORBIDDEN:
+		return "forbidden"
+	default:
+		return "unknown"
+	}
+}
+
+// sendErrorPolicy is what the send queue does about a failed message.
+type sendErrorPolicy struct {
+	// Try again after a growing delay, up to SEND_MAX_ATTEMPTS times.
+	retry bool
+	// Try again once Telegram says so, up to SEND_MAX_FLOOD_WAITS times.
+	wait bool
+	// The chat cannot receive anything, so disconnect the user.
+	kick bool
+}
+
+var sendErrorPolicies = map[SendErrorClass]sendErrorPolicy{
+	SEND_ERROR_OTHER:          {},
+	SEND_ERROR_NETWORK:        {retry: true},
+	SEND_ERROR_SERVER:         {retry: true},
+	SEND_ERROR_FLOOD:          {wait: true},
+	SEND_ERROR_BAD_REQUEST:    {},
+	SEND_ERROR_BLOCKED:        {kick: true},
+	SEND_ERROR_DEACTIVATED:    {kick: true},
+	SEND_ERROR_CHAT_NOT_FOUND: {kick: true},
+	SEND_ERROR_KICKED:         {kick: true},
+	SEND_ERROR_FORBIDDEN:      {kick: true},
+}
+
+// classifySendError tells why a message failed to send, and how long
+// Telegram asked to wait before trying again, if it did.
+//
+// The library drops the error code, but the description starts with the
+// HTTP status text, like "Forbidden: bot was blocked by the user".
+// Errors that never reached Telegram are only worth retrying if the
+// network failed; anything else, like a request that cannot be encoded,
+// fails the same way every time.
+func classifySendError(err error) (class SendErrorClass, retry_after time.Duration) {
+	api_err, ok := err.(tgbotapi.Error)
+	if !ok {
+		var net_err net.Error
+		var syntax_err *json.SyntaxError
+		switch {
+		case errors.As(err, &net_err), errors.Is(err, io.ErrUnexpectedEOF):
+			return SEND_ERROR_NETWORK, 0
+		case errors.As(err, &syntax_err):
+			// Not a Bot API answer, like an error page from a proxy.
+			return SEND_ERROR_SERVER, 0
+		}
+		return SEND_ERROR_OTHER, 0
+	}
+	if api_err.RetryAfter != 0 {
+		return SEND_ERROR_FLOOD, time.Duration(api_err.RetryAfter) * time.Second
+	}
+	status, reason, _ := strings.Cut(api_err.Message, ": ")
+	switch status {
+	case "Too Many Requests":
+		// Without retry_after, wait as long as for any passing failure.
+		return SEND_ERROR_FLOOD, SEND_RETRY_DELAY
+	case "Internal Server Error", "Bad Gateway", "Service Unavailable", "Gateway Timeout":
+		return SEND_ERROR_SERVER, 0
+	case "Bad Request":
+		if reason == "chat not found" {
+			return SEND_ERROR_CHAT_NOT_FOUND, 0
+		}
+		return SEND_ERROR_BAD_REQUEST, 0
+	case "Forbidden":
+		switch {
+		case reason == "bot was blocked by the user":
+			return SEND_ERROR_BLOCKED, 0
+		case reason == "user is deactivated":
+			return SEND_ERROR_DEACTIVATED, 0
+		case strings.HasPrefix(reason, "bot was kicked"):
+			return SEND_ERROR_KICKED, 0
+		}
+		return SEND_ERROR_FORBIDDEN, 0
+	}
+	return SEND_ERROR_OTHER, 0
+}
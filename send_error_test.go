@@ -0,0 +1,104 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestClassifySendError(t *testing.T) {
+	var page interface{}
+	syntax_err := json.Unmarshal([]byte("<html>502 Bad Gateway</html>"), &page)
+	tests := []struct {
+		name        string
+		err         error
+		class       SendErrorClass
+		retry_after time.Duration
+	}{
+		{"connection reset", &url.Error{Op: "Post", URL: "https://api.telegram.org/", Err: syscall.ECONNRESET}, SEND_ERROR_NETWORK, 0},
+		{"timeout", &url.Error{Op: "Post", URL: "https://api.telegram.org/", Err: context.DeadlineExceeded}, SEND_ERROR_NETWORK, 0},
+		{"dial", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, SEND_ERROR_NETWORK, 0},
+		{"cut short", fmt.Errorf("reading answer: %w", io.ErrUnexpectedEOF), SEND_ERROR_NETWORK, 0},
+		{"proxy page", syntax_err, SEND_ERROR_SERVER, 0},
+		{"encoding", &json.UnsupportedTypeError{Type: reflect.TypeOf(func() {})}, SEND_ERROR_OTHER, 0},
+		{"local", errors.New("send queue: cannot send tgbotapi.ChatActionConfig"), SEND_ERROR_OTHER, 0},
+		{"flood", tgbotapi.Error{Message: "Too Many Requests: retry after 3", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 3}}, SEND_ERROR_FLOOD, 3 * time.Second},
+		{"flood without wait", tgbotapi.Error{Message: "Too Many Requests"}, SEND_ERROR_FLOOD, SEND_RETRY_DELAY},
+		{"outage", tgbotapi.Error{Message: "Bad Gateway"}, SEND_ERROR_SERVER, 0},
+		{"chat not found", tgbotapi.Error{Message: "Bad Request: chat not found"}, SEND_ERROR_CHAT_NOT_FOUND, 0},
+		{"bad request", tgbotapi.Error{Message: "Bad Request: message text is empty"}, SEND_ERROR_BAD_REQUEST, 0},
+		{"blocked", tgbotapi.Error{Message: "Forbidden: bot was blocked by the user"}, SEND_ERROR_BLOCKED, 0},
+		{"deactivated", tgbotapi.Error{Message: "Forbidden: user is deactivated"}, SEND_ERROR_DEACTIVATED, 0},
+		{"kicked", tgbotapi.Error{Message: "Forbidden: bot was kicked from the group chat"}, SEND_ERROR_KICKED, 0},
+		{"forbidden", tgbotapi.Error{Message: "Forbidden: bot can't initiate conversation with a user"}, SEND_ERROR_FORBIDDEN, 0},
+		{"unknown", tgbotapi.Error{Message: "I'm a teapot"}, SEND_ERROR_OTHER, 0},
+	}
+	for _, test := range tests {
+		class, retry_after := classifySendError(test.err)
+		if class != test.class || retry_after != test.retry_after {
+			t.Errorf("%s: got %v after %v, want %v after %v", test.name, class, retry_after, test.class, test.retry_after)
+		}
+	}
+}
+
+func TestSendQueueUnknownMessage(t *testing.T) {
+	q, transport, clock := newRateTestQueue(t, &RateLimitConfig{Global: 30, GlobalBurst: 30, PerChat: 1, PerChatBurst: 3})
+
+	done := make(chan []error, 2)
+	callback := func(result []*tgbotapi.Message, errs []error) {
+		done <- errs
+	}
+	// Nothing to send, so it is done at once.
+	q.Send(QUEUE_PRIORITY_NORMAL, []tgbotapi.Chattable{tgbotapi.NewChatAction(1, tgbotapi.ChatTyping)}, callback)
+	select {
+	case errs := <-done:
+		if errs[0] == nil {
+			t.Fatal("unknown message did not fail")
+		}
+	default:
+		t.Fatal("no callback for an unknown message")
+	}
+
+	// The rest of the messages still go out.
+	q.Send(QUEUE_PRIORITY_NORMAL, []tgbotapi.Chattable{
+		tgbotapi.NewMessage(1, "你好"),
+		tgbotapi.NewChatAction(1, tgbotapi.ChatTyping),
+		tgbotapi.NewMessage(2, "你好"),
+	}, callback)
+	drainRateTestQueue(t, q, clock)
+	errs := <-done
+	if errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Fatalf("got errors %v", errs)
+	}
+	if len(transport.SentTo(1)) != 1 || len(transport.SentTo(2)) != 1 {
+		t.Fatal("messages next to the unknown one were not sent")
+	}
+}
@@ -20,8 +20,8 @@ package main
 
 import (
 	"container/list"
+	"fmt"
 	"log"
-	"reflect"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -32,11 +32,15 @@ import (
 type sendQueueItem struct {
 	priority   int
 	msg_config []tgbotapi.Chattable
+	// The chat each message goes to.
+	msg_chat   []int64
 	msg_result []*tgbotapi.Message
 	msg_errors []error
 	msg_index  int
 	msg_finish uintptr
 	callback   func([]*tgbotapi.Message, []error)
+	// IDs in the outbox, 0 for the messages not in it.
+	outbox_ids []int64
 }
 
 const (
@@ -46,128 +50,631 @@ const (
 )
 
 type sendQueue struct {
-	bot    *tgbotapi.BotAPI
-	dbm    *dbManager
-	lock   *sync.Mutex
-	cv     *sync.Cond
-	low    *list.List
-	normal *list.List
-	high   *list.List
+	clock     Clock
+	transport Transport
+	dbm       Storage
+	outbox    Outbox // Nil unless Config.Outbox is set.
+	limits    *RateLimitConfig
+	lock      *sync.Mutex
+	cv        *sync.Cond
+	low       *list.List
+	normal    *list.List
+	high      *list.List
+
+	// Protected by lock.
+	closing  bool
+	aborted  bool
+	inflight int
+	drained  chan struct{}
+	// The chats recently sent to, and those with messages held back.
+	chats   map[int64]*chatState
+	holding map[int64]*chatState
+	global  *tokenBucket
+	// Flood control on the whole bot.
+	paused_until time.Time
+	// When the dispatcher is woken up to send a held message.
+	waking_at time.Time
+	pruned_at time.Time
+}
+
+// Flood control right after another message to the same chat is taken
+// as the limit of that chat, otherwise as the limit of the whole bot.
+const SEND_CHAT_INTERVAL = time.Second
+
+// A message failing for a reason that may go away, like a network error,
+// is tried up to SEND_MAX_ATTEMPTS times, first after SEND_RETRY_DELAY,
+// then twice as long each time. Flood control is obeyed up to
+// SEND_MAX_FLOOD_WAITS times.
+const (
+	SEND_MAX_ATTEMPTS    = 5
+	SEND_RETRY_DELAY     = time.Second
+	SEND_MAX_FLOOD_WAITS = 10
+)
+
+// heldMessage is a message of an item, held back until its chat is ready.
+type heldMessage struct {
+	item  *sendQueueItem
+	index int
+	// Failed attempts and flood control waits so far.
+	attempts    int
+	flood_waits int
+}
+
+type chatState struct {
+	// Sent in order, once ready_at has passed, the bucket allows it and
+	// nothing is in flight.
+	held     []heldMessage
+	inflight bool
+	ready_at time.Time
+	bucket   *tokenBucket
+	// When the last two messages were sent.
+	last_sent     time.Time
+	previous_sent time.Time
 }
 
-func NewSendQueue(bot *tgbotapi.BotAPI, dbm *dbManager) *sendQueue {
+// NewSendQueue starts sending, beginning with what is left in the outbox,
+// if there is one.
+func NewSendQueue(clock Clock, transport Transport, dbm Storage, outbox Outbox, limits *RateLimitConfig) (*sendQueue, error) {
 	q := &sendQueue{
-		bot:    bot,
-		dbm:    dbm,
-		lock:   new(sync.Mutex),
-		cv:     sync.NewCond(new(sync.Mutex)),
-		low:    list.New(),
-		normal: list.New(),
-		high:   list.New(),
+		clock:     clock,
+		transport: transport,
+		dbm:       dbm,
+		outbox:    outbox,
+		limits:    limits,
+		lock:      new(sync.Mutex),
+		cv:        sync.NewCond(new(sync.Mutex)),
+		low:       list.New(),
+		normal:    list.New(),
+		high:      list.New(),
+
+		drained: make(chan struct{}),
+		chats:   make(map[int64]*chatState),
+		holding: make(map[int64]*chatState),
+		global:  newTokenBucket(limits.Global, limits.GlobalBurst, clock.Now()),
+	}
+	if outbox != nil {
+		err := q.resume()
+		if err != nil {
+			return nil, err
+		}
 	}
 	go q.dispatchMessages()
-	return q
+	return q, nil
+}
+
+func (q *sendQueue) listOf(priority int) *list.List {
+	switch priority {
+	case QUEUE_PRIORITY_LOW:
+		return q.low
+	case QUEUE_PRIORITY_NORMAL:
+		return q.normal
+	case QUEUE_PRIORITY_HIGH:
+		return q.high
+	default:
+		panic("Unknown priority")
+	}
 }
 
 func (q *sendQueue) Send(priority int, msg_config []tgbotapi.Chattable, callback func([]*tgbotapi.Message, []error)) {
 	item := &sendQueueItem{
 		priority:   priority,
 		msg_config: msg_config,
+		msg_chat:   make([]int64, len(msg_config)),
 		msg_result: make([]*tgbotapi.Message, len(msg_config)),
 		msg_errors: make([]error, len(msg_config)),
 		msg_index:  0,
 		msg_finish: 0,
 		callback:   callback,
 	}
-	var msg_list *list.List
-	switch priority {
-	case QUEUE_PRIORITY_LOW:
-		msg_list = q.low
-	case QUEUE_PRIORITY_NORMAL:
-		msg_list = q.normal
-	case QUEUE_PRIORITY_HIGH:
-		msg_list = q.high
-	default:
-		panic("Unknown priority")
+	rejected := 0
+	for i, c := range msg_config {
+		item.msg_chat[i], item.msg_errors[i] = recipientOf(c)
+		if item.msg_errors[i] != nil {
+			log.Printf("Error: %+v\n", item.msg_errors[i])
+			rejected++
+		}
+	}
+	for i := 0; i < rejected; i++ {
+		q.finish(item)
 	}
+	if rejected != 0 && rejected == len(msg_config) {
+		return
+	}
+	msg_list := q.listOf(priority)
+	// Stored even after shutdown, to be sent on the next start.
+	item.outbox_ids = q.store(priority, msg_config)
 	q.lock.Lock()
+	if q.aborted {
+		q.lock.Unlock()
+		log.Printf("Send queue is shut down, dropped %d messages\n", len(msg_config)-q.countStored(item))
+		return
+	}
 	msg_list.PushBack(item)
 	q.lock.Unlock()
+	q.wake()
+}
+
+// store writes the messages to the outbox and returns their IDs.
+func (q *sendQueue) store(priority int, msg_config []tgbotapi.Chattable) []int64 {
+	if q.outbox == nil {
+		return nil
+	}
+	ids := make([]int64, len(msg_config))
+	entries := make([]OutboxEntry, 0, len(msg_config))
+	indices := make([]int, 0, len(msg_config))
+	for i, c := range msg_config {
+		entry, err := encodeOutboxEntry(priority, c)
+		if err != nil {
+			log.Printf("Error: %+v\n", err)
+			continue
+		}
+		entries = append(entries, entry)
+		indices = append(indices, i)
+	}
+	if len(entries) == 0 {
+		return ids
+	}
+	err := q.outbox.AddToOutbox(entries)
+	if err != nil {
+		log.Printf("Error: %+v\n", err)
+		return ids
+	}
+	for j, entry := range entries {
+		ids[indices[j]] = entry.ID
+	}
+	return ids
+}
+
+// countStored returns how many messages of the item are in the outbox.
+func (q *sendQueue) countStored(item *sendQueueItem) (count int) {
+	for _, id := range item.outbox_ids {
+		if id != 0 {
+			count++
+		}
+	}
+	return
+}
+
+// resume queues what the last run left in the outbox.
+func (q *sendQueue) resume() error {
+	entries, err := q.outbox.ListOutbox()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	items := make(map[int]*sendQueueItem)
+	for _, entry := range entries {
+		c, err := decodeOutboxEntry(entry)
+		if err != nil {
+			log.Printf("Error: %+v\n", err)
+			q.unstore(entry.ID)
+			continue
+		}
+		priority := entry.Priority
+		if priority < QUEUE_PRIORITY_LOW || priority > QUEUE_PRIORITY_HIGH {
+			priority = QUEUE_PRIORITY_NORMAL
+		}
+		item := items[priority]
+		if item == nil {
+			item = &sendQueueItem{priority: priority}
+			items[priority] = item
+		}
+		chat, err := recipientOf(c)
+		if err != nil {
+			log.Printf("Error: %+v\n", err)
+			q.unstore(entry.ID)
+			continue
+		}
+		item.msg_config = append(item.msg_config, c)
+		item.msg_chat = append(item.msg_chat, chat)
+		item.outbox_ids = append(item.outbox_ids, entry.ID)
+	}
+	for priority, item := range items {
+		item.msg_result = make([]*tgbotapi.Message, len(item.msg_config))
+		item.msg_errors = make([]error, len(item.msg_config))
+		q.listOf(priority).PushBack(item)
+	}
+	log.Printf("Resuming %d messages left in the outbox.\n", len(entries))
+	return nil
+}
+
+// unstore removes a message from the outbox once it is done with.
+func (q *sendQueue) unstore(id int64) {
+	if id == 0 {
+		return
+	}
+	err := q.outbox.RemoveFromOutbox(id)
+	if err != nil {
+		log.Printf("Error: %+v\n", err)
+	}
+}
+
+// Idle reports whether nothing is waiting or being sent.
+func (q *sendQueue) Idle() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.inflight != 0 || len(q.holding) != 0 {
+		return false
+	}
+	for _, msg_list := range []*list.List{q.high, q.normal, q.low} {
+		for el := msg_list.Front(); el != nil; el = el.Next() {
+			item := el.Value.(*sendQueueItem)
+			if item.msg_index != len(item.msg_config) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (q *sendQueue) wake() {
+	q.cv.L.Lock()
 	q.cv.Signal()
+	q.cv.L.Unlock()
+}
+
+// Shutdown lets the queue drain until the deadline, then drops the rest,
+// except what is in the outbox. It returns the number of messages dropped.
+func (q *sendQueue) Shutdown(deadline time.Time) (dropped int) {
+	q.lock.Lock()
+	q.closing = true
+	q.lock.Unlock()
+	q.wake()
+
+	select {
+	case <-q.drained:
+		return 0
+	case <-time.After(time.Until(deadline)):
+	}
+
+	q.lock.Lock()
+	q.aborted = true
+	kept := 0
+	for _, msg_list := range []*list.List{q.high, q.normal, q.low} {
+		for el := msg_list.Front(); el != nil; el = el.Next() {
+			item := el.Value.(*sendQueueItem)
+			for i := item.msg_index; i < len(item.msg_config); i++ {
+				if item.msg_errors[i] != nil {
+					continue
+				} else if item.outbox_ids != nil && item.outbox_ids[i] != 0 {
+					kept++
+				} else {
+					dropped++
+				}
+			}
+		}
+		msg_list.Init()
+	}
+	for chat, state := range q.holding {
+		for _, msg := range state.held {
+			if msg.item.outbox_ids != nil && msg.item.outbox_ids[msg.index] != 0 {
+				kept++
+			} else {
+				dropped++
+			}
+		}
+		state.held = nil
+		delete(q.holding, chat)
+	}
+	inflight := q.inflight
+	q.lock.Unlock()
+	q.wake()
+
+	if kept != 0 {
+		log.Printf("Left %d unsent messages in the outbox\n", kept)
+	}
+
+	if inflight != 0 {
+		log.Printf("Abandoned %d messages still being sent\n", inflight)
+	}
+	return
 }
 
 func (q *sendQueue) dispatchMessages() {
 	for {
 		q.lock.Lock()
-		if el := q.high.Front(); el != nil {
-			item := el.Value.(*sendQueueItem)
-			if item.msg_index == len(item.msg_config) {
-				q.high.Remove(el)
+		now := q.clock.Now()
+		if q.aborted {
+			q.lock.Unlock()
+			close(q.drained)
+			return
+		}
+		if now.Before(q.paused_until) {
+			q.wait(q.paused_until)
+			continue
+		}
+		if ready := q.global.ready(now); ready.After(now) {
+			q.wait(ready)
+			continue
+		}
+		q.prune(now)
+		if msg, ok := q.takeHeld(now); ok {
+			q.lock.Unlock()
+			q.dispatchMessage(msg)
+		} else if msg, ok := q.takeNext(); ok {
+			chat := msg.item.msg_chat[msg.index]
+			state := q.chats[chat]
+			if state != nil && (state.inflight || len(state.held) != 0 || state.readyAt(now).After(now)) {
+				// Keep the messages to a chat in order.
+				q.hold(chat, state, msg)
 				q.lock.Unlock()
 			} else {
 				q.lock.Unlock()
-				q.dispatchMessage(item)
+				q.dispatchMessage(msg)
 			}
-		} else if el := q.normal.Front(); el != nil {
+		} else if len(q.holding) != 0 {
+			q.wait(q.nextReady(now))
+		} else if q.closing && q.inflight == 0 {
+			q.aborted = true
+			q.lock.Unlock()
+			close(q.drained)
+			return
+		} else {
+			q.wait(time.Time{})
+		}
+	}
+}
+
+// wait sleeps until woken, or until t if it is not zero.
+// Must be called with q.lock held, which it releases.
+func (q *sendQueue) wait(t time.Time) {
+	now := q.clock.Now()
+	if !t.IsZero() && (q.waking_at.IsZero() || !q.waking_at.After(now) || t.Before(q.waking_at)) {
+		q.waking_at = t
+		timer := q.clock.After(t.Sub(now))
+		go func() {
+			<-timer
+			q.wake()
+		}()
+	}
+	q.cv.L.Lock()
+	q.lock.Unlock()
+	q.cv.Wait()
+	q.cv.L.Unlock()
+}
+
+// takeNext returns the next message in the queue, by priority.
+// Must be called with q.lock held.
+func (q *sendQueue) takeNext() (msg heldMessage, ok bool) {
+	for _, msg_list := range []*list.List{q.high, q.normal, q.low} {
+		for el := msg_list.Front(); el != nil; el = msg_list.Front() {
 			item := el.Value.(*sendQueueItem)
 			if item.msg_index == len(item.msg_config) {
-				q.normal.Remove(el)
-				q.lock.Unlock()
-			} else {
-				q.lock.Unlock()
-				q.dispatchMessage(item)
+				msg_list.Remove(el)
+				continue
 			}
-		} else if el := q.low.Front(); el != nil {
-			item := el.Value.(*sendQueueItem)
-			if item.msg_index == len(item.msg_config) {
-				q.low.Remove(el)
-				q.lock.Unlock()
-			} else {
-				q.lock.Unlock()
-				q.dispatchMessage(item)
+			msg = heldMessage{item: item, index: item.msg_index}
+			item.msg_index++
+			if item.msg_errors[msg.index] != nil {
+				// Already failed in Send.
+				continue
 			}
-		} else {
-			q.cv.L.Lock()
-			q.lock.Unlock()
-			q.cv.Wait()
-			q.cv.L.Unlock()
+			return msg, true
+		}
+	}
+	return
+}
+
+// hold keeps the message until its chat is ready.
+// Must be called with q.lock held.
+func (q *sendQueue) hold(chat int64, state *chatState, msg heldMessage) {
+	state.held = append(state.held, msg)
+	q.holding[chat] = state
+}
+
+// takeHeld returns a held message whose chat is ready by now,
+// the one with the highest priority.
+// Must be called with q.lock held.
+func (q *sendQueue) takeHeld(now time.Time) (msg heldMessage, ok bool) {
+	var chat int64
+	for c, state := range q.holding {
+		if state.inflight || state.readyAt(now).After(now) {
+			continue
+		}
+		if !ok || state.held[0].item.priority > msg.item.priority {
+			chat, msg, ok = c, state.held[0], true
+		}
+	}
+	if ok {
+		state := q.holding[chat]
+		state.held = state.held[1:]
+		if len(state.held) == 0 {
+			state.held = nil
+			delete(q.holding, chat)
+		}
+	}
+	return
+}
+
+// nextReady returns when the next held chat is ready, or zero if they are
+// all waiting for a message being sent.
+// Must be called with q.lock held.
+func (q *sendQueue) nextReady(now time.Time) (t time.Time) {
+	for _, state := range q.holding {
+		if ready := state.readyAt(now); !state.inflight && (t.IsZero() || ready.Before(t)) {
+			t = ready
+		}
+	}
+	return
+}
+
+// readyAt returns when the chat may be sent to next, apart from waiting
+// for a message in flight.
+func (state *chatState) readyAt(now time.Time) time.Time {
+	ready := state.bucket.ready(now)
+	if state.ready_at.After(ready) {
+		return state.ready_at
+	}
+	return ready
+}
+
+// prune forgets the chats not sent to for a while.
+// Must be called with q.lock held.
+func (q *sendQueue) prune(now time.Time) {
+	if now.Sub(q.pruned_at) < time.Minute {
+		return
+	}
+	q.pruned_at = now
+	for chat, state := range q.chats {
+		if !state.inflight && len(state.held) == 0 && now.Sub(state.last_sent) >= SEND_CHAT_INTERVAL && !now.Before(state.ready_at) && state.bucket.full(now) {
+			delete(q.chats, chat)
 		}
 	}
 }
 
-func (q *sendQueue) dispatchMessage(item *sendQueueItem) {
-	i := item.msg_index
-	item.msg_index = i + 1
+func (q *sendQueue) dispatchMessage(msg heldMessage) {
+	item, i := msg.item, msg.index
+	chat := item.msg_chat[i]
 
-	delay := time.After(40 * time.Millisecond)
+	q.lock.Lock()
+	sent_at := q.clock.Now()
+	state := q.chats[chat]
+	if state == nil {
+		state = &chatState{
+			bucket: newTokenBucket(q.limits.PerChat, q.limits.PerChatBurst, sent_at),
+		}
+		q.chats[chat] = state
+	}
+	state.inflight = true
+	state.previous_sent, state.last_sent = state.last_sent, sent_at
+	q.global.take(sent_at)
+	state.bucket.take(sent_at)
+	q.inflight++
+	q.lock.Unlock()
 
 	go func() {
+		defer func() {
+			q.lock.Lock()
+			q.inflight--
+			q.lock.Unlock()
+			q.wake()
+		}()
+
 		result := new(tgbotapi.Message)
 		var err error
-		*result, err = q.bot.Send(item.msg_config[i])
+		*result, err = q.transport.Send(item.msg_config[i])
+		if err != nil && q.retryLater(chat, state, msg, err, sent_at) {
+			return
+		}
+		q.lock.Lock()
+		state.inflight = false
+		q.lock.Unlock()
+
 		item.msg_result[i], item.msg_errors[i] = result, err
+		if item.outbox_ids != nil {
+			q.unstore(item.outbox_ids[i])
+		}
 
 		if err != nil {
-			reflect_msg := reflect.ValueOf(item.msg_config[i])
-			chat_id := reflect_msg.FieldByName("ChatID").Interface()
-			log.Printf("Send to #%+v failed: %+v\n", chat_id, err)
-
-			if err.Error() == "Forbidden: bot was blocked by the user" || err.Error() == "Forbidden: user is deactivated" {
-				if chat_id_int64, ok := chat_id.(int64); ok {
-					log.Printf("Removing #%+v from list\n", chat_id)
-					q.kickUser(chat_id_int64)
-				}
-			}
-		}
+			class, _ := classifySendError(err)
+			log.Printf("Send to #%+v failed (%v): %+v\n", chat, class, err)
 
-		if int(atomic.AddUintptr(&item.msg_finish, 1)) == len(item.msg_config) {
-			if item.callback != nil {
-				item.callback(item.msg_result, item.msg_errors)
+			if sendErrorPolicies[class].kick {
+				log.Printf("Removing #%+v from list\n", chat)
+				q.kickUser(chat)
 			}
 		}
+
+		q.finish(item)
 	}()
+}
 
-	<-delay
+// finish counts a message of the item as done, and calls back once all
+// of them are.
+func (q *sendQueue) finish(item *sendQueueItem) {
+	if int(atomic.AddUintptr(&item.msg_finish, 1)) == len(item.msg_config) {
+		if item.callback != nil {
+			item.callback(item.msg_result, item.msg_errors)
+		}
+	}
+}
+
+// retryLater holds the message back if the error may go away,
+// and reports whether it did. The callback only hears of the failure
+// once the attempts are used up.
+func (q *sendQueue) retryLater(chat int64, state *chatState, msg heldMessage, err error, sent_at time.Time) bool {
+	class, retry_after := classifySendError(err)
+	policy := sendErrorPolicies[class]
+	var delay time.Duration
+	switch {
+	case policy.wait:
+		msg.flood_waits++
+		if msg.flood_waits > SEND_MAX_FLOOD_WAITS {
+			return false
+		}
+		delay = retry_after
+	case policy.retry:
+		msg.attempts++
+		if msg.attempts >= SEND_MAX_ATTEMPTS {
+			return false
+		}
+		delay = SEND_RETRY_DELAY << (msg.attempts - 1)
+	default:
+		return false
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	state.inflight = false
+	if q.aborted {
+		// Dropped, but left in the outbox.
+		return true
+	}
+	ready_at := q.clock.Now().Add(delay)
+	switch {
+	case !policy.wait:
+		log.Printf("Send to #%+v failed (%v), retrying in %v: %+v\n", chat, class, delay, err)
+	case sent_at.Sub(state.previous_sent) < SEND_CHAT_INTERVAL:
+		log.Printf("Flood control on #%+v, pausing it for %v\n", chat, delay)
+	default:
+		// Nothing else was sent to the chat just now, so the limit is
+		// on the bot.
+		log.Printf("Flood control, pausing all sends for %v\n", delay)
+		if ready_at.After(q.paused_until) {
+			q.paused_until = ready_at
+		}
+	}
+	if ready_at.After(state.ready_at) {
+		state.ready_at = ready_at
+	}
+	state.held = append([]heldMessage{msg}, state.held...)
+	q.holding[chat] = state
+	return true
+}
+
+// recipientOf returns the chat a message is sent to.
+// It knows the same messages as the outbox.
+func recipientOf(c tgbotapi.Chattable) (chat int64, err error) {
+	switch c := c.(type) {
+	case tgbotapi.MessageConfig:
+		return c.ChatID, nil
+	case tgbotapi.ForwardConfig:
+		return c.ChatID, nil
+	case tgbotapi.PhotoConfig:
+		return c.ChatID, nil
+	case tgbotapi.AudioConfig:
+		return c.ChatID, nil
+	case tgbotapi.DocumentConfig:
+		return c.ChatID, nil
+	case tgbotapi.StickerConfig:
+		return c.ChatID, nil
+	case tgbotapi.VideoConfig:
+		return c.ChatID, nil
+	case tgbotapi.VideoNoteConfig:
+		return c.ChatID, nil
+	case tgbotapi.VoiceConfig:
+		return c.ChatID, nil
+	case tgbotapi.LocationConfig:
+		return c.ChatID, nil
+	case tgbotapi.VenueConfig:
+		return c.ChatID, nil
+	case tgbotapi.ContactConfig:
+		return c.ChatID, nil
+	default:
+		return 0, fmt.Errorf("send queue: cannot send %T", c)
+	}
 }
 
 func (q *sendQueue) kickUser(user_a int64) {
@@ -175,15 +682,7 @@ func (q *sendQueue) kickUser(user_a int64) {
 		log.Println("kickUser: user_a == 0")
 		return
 	}
-	err := q.dbm.RemoveInvitation(user_a)
-	if err != nil {
-		log.Println(err)
-	}
-	err = q.dbm.DisconnectChat(user_a, 0)
-	if err != nil {
-		log.Println(err)
-	}
-	err = q.dbm.LeaveLobby(user_a)
+	_, err := q.dbm.KickUser(user_a)
 	if err != nil {
 		log.Println(err)
 	}
@@ -0,0 +1,267 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Secret   string    `json:"secret"`
+	Debug    bool      `json:"debug"`
+	Storage  string    `json:"storage"`
+	Database string    `json:"database"` // A file for SQLite, a connection string for PostgreSQL.
+	Schedule *Schedule `json:"schedule"`
+
+	// Keep the state of users and bans in memory, so messages are
+	// forwarded without reading the database. Only with SQLite, and only
+	// if no other bot uses the database. Changes made with the admin
+	// commands are seen within a second; send the bot SIGHUP after
+	// changing users any other way.
+	Cache bool `json:"cache"`
+
+	// Number of updates handled at the same time.
+	// Updates from the same chat are always handled in order.
+	Workers int `json:"workers"`
+
+	// Keep the send queue in the database, so the messages not yet sent
+	// on exit are sent on the next start. Do not share the database with
+	// another bot with this turned on.
+	Outbox bool `json:"outbox"`
+
+	// Hours before a user idle in the lobby is disconnected, 0 for never.
+	IdleTimeout int `json:"idle_timeout"`
+
+	// Snapshots taken by the backup command and /backup.
+	Backup *BackupConfig `json:"backup"`
+
+	// How fast the send queue sends.
+	RateLimit *RateLimitConfig `json:"rate_limit"`
+
+	// Seconds to wait for the send queue to drain on exit.
+	ShutdownTimeout int `json:"shutdown_timeout"`
+
+	// Use long polling if Webhook is not set.
+	Webhook *WebhookConfig `json:"webhook"`
+}
+
+type WebhookConfig struct {
+	// The public URL registered to Telegram.
+	URL string `json:"url"`
+	// The local address and path to listen on.
+	Listen string `json:"listen"`
+	Path   string `json:"path"`
+	// Required. Telegram sends it back in every request, so we know it is genuine.
+	SecretToken    string `json:"secret_token"`
+	CertFile       string `json:"cert_file"`
+	KeyFile        string `json:"key_file"`
+	SelfSigned     bool   `json:"self_signed"`
+	MaxConnections int    `json:"max_connections"`
+}
+
+// Environment variables override the values in the configuration file.
+const (
+	ENV_SECRET   = "WORLDTREE_SECRET"
+	ENV_DEBUG    = "WORLDTREE_DEBUG"
+	ENV_STORAGE  = "WORLDTREE_STORAGE"
+	ENV_DATABASE = "WORLDTREE_DATABASE"
+
+	ENV_WEBHOOK_SECRET_TOKEN = "WORLDTREE_WEBHOOK_SECRET_TOKEN"
+)
+
+// Set by config.go, if you made one from config.go.example.
+var builtinConfig func(conf *Config)
+
+func NewConfig() *Config {
+	conf := &Config{
+		Storage:  STORAGE_SQLITE,
+		Database: "./bot.db",
+		Schedule: NewDefaultSchedule(),
+		Workers:  8,
+
+		IdleTimeout: 7 * 24,
+		Backup: &BackupConfig{
+			Dir:  "./backups",
+			Keep: 7,
+		},
+		RateLimit: &RateLimitConfig{
+			Global:       30,
+			GlobalBurst:  30,
+			PerChat:      1,
+			PerChatBurst: 3,
+		},
+
+		ShutdownTimeout: 30,
+	}
+	if builtinConfig != nil {
+		builtinConfig(conf)
+	}
+	return conf
+}
+
+func LoadConfig(path string) (conf *Config, err error) {
+	conf = NewConfig()
+
+	if path != "" {
+		var f *os.File
+		f, err = os.Open(path)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(conf)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", path, err)
+			return
+		}
+	}
+
+	err = conf.loadEnv()
+	if err != nil {
+		return
+	}
+
+	err = conf.Validate()
+	return
+}
+
+func (conf *Config) loadEnv() error {
+	if value, ok := os.LookupEnv(ENV_SECRET); ok {
+		conf.Secret = value
+	}
+	if value, ok := os.LookupEnv(ENV_DEBUG); ok {
+		debug, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", ENV_DEBUG, err)
+		}
+		conf.Debug = debug
+	}
+	if value, ok := os.LookupEnv(ENV_STORAGE); ok {
+		conf.Storage = value
+	}
+	if value, ok := os.LookupEnv(ENV_DATABASE); ok {
+		conf.Database = value
+	}
+	if value, ok := os.LookupEnv(ENV_WEBHOOK_SECRET_TOKEN); ok && conf.Webhook != nil {
+		conf.Webhook.SecretToken = value
+	}
+	return nil
+}
+
+func (conf *Config) Validate() error {
+	if conf.Secret == "" || conf.Secret == "MY_BOT_API_TOKEN" {
+		return errors.New("config: secret is not set")
+	}
+	switch conf.Storage {
+	case STORAGE_SQLITE, STORAGE_POSTGRES:
+		if conf.Database == "" {
+			return errors.New("config: database is not set")
+		}
+		if conf.Cache && conf.Storage == STORAGE_POSTGRES {
+			return errors.New("config: cache cannot be used with postgres, other bots may share the database")
+		}
+	case STORAGE_MEMORY:
+		if conf.Outbox {
+			return errors.New("config: outbox needs a database")
+		}
+	default:
+		return fmt.Errorf("config: unknown storage: %q", conf.Storage)
+	}
+	if conf.Schedule == nil {
+		return errors.New("config: schedule is not set")
+	}
+	if conf.Workers < 1 {
+		return fmt.Errorf("config: workers must be at least 1: %d", conf.Workers)
+	}
+	if conf.IdleTimeout < 0 {
+		return fmt.Errorf("config: idle_timeout is negative: %d", conf.IdleTimeout)
+	}
+	if conf.Backup == nil {
+		return errors.New("config: backup is not set")
+	}
+	err := conf.Backup.Validate()
+	if err != nil {
+		return err
+	}
+	if conf.RateLimit == nil {
+		return errors.New("config: rate_limit is not set")
+	}
+	err = conf.RateLimit.Validate()
+	if err != nil {
+		return err
+	}
+	if conf.ShutdownTimeout < 0 {
+		return fmt.Errorf("config: shutdown_timeout is negative: %d", conf.ShutdownTimeout)
+	}
+	if conf.Webhook != nil {
+		err = conf.Webhook.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (conf *WebhookConfig) Validate() error {
+	u, err := url.Parse(conf.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("config: webhook url must be an https URL: %q", conf.URL)
+	}
+	if conf.Listen == "" {
+		return errors.New("config: webhook listen is not set")
+	}
+	if conf.Path == "" {
+		conf.Path = u.Path
+	}
+	if !strings.HasPrefix(conf.Path, "/") {
+		return fmt.Errorf("config: webhook path must start with \"/\": %q", conf.Path)
+	}
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return errors.New("config: webhook cert_file and key_file must be set together")
+	}
+	if conf.SelfSigned && conf.CertFile == "" {
+		return errors.New("config: webhook self_signed requires cert_file")
+	}
+	if conf.SecretToken == "" {
+		// Otherwise anyone who can reach the listener could send updates.
+		return errors.New("config: webhook secret_token is not set")
+	}
+	if len(conf.SecretToken) > 256 {
+		return errors.New("config: webhook secret_token is longer than 256 characters")
+	}
+	for _, c := range conf.SecretToken {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return errors.New("config: webhook secret_token may only contain A-Z, a-z, 0-9, _ and -")
+		}
+	}
+	return nil
+}
+
+func (conf *Config) IsOpenHour(t time.Time) bool {
+	return conf.Debug || conf.Schedule.IsOpen(t)
+}
@@ -0,0 +1,102 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlDialect holds what differs between the SQL databases dbManager runs on.
+// The queries in db.go are written with ? placeholders, in the SQL both
+// SQLite and PostgreSQL understand, and quote "user" as PostgreSQL reserves it.
+type sqlDialect struct {
+	// Also the directory of the migrations.
+	name   string
+	driver string
+	// Number the placeholders $1, $2, ... instead of ?.
+	dollar_placeholders bool
+	// Returns 1 if the schema_version table exists, otherwise 0.
+	has_schema_version string
+	// Run at the start of each migration, so two processes starting
+	// at the same time do not both apply it.
+	lock_migrations string
+	// Appended to the query looking for an invitation to claim.
+	skip_locked string
+	// Turns the configured database into a connection string.
+	dsn func(database string) string
+}
+
+var sqliteDialect = &sqlDialect{
+	name:               STORAGE_SQLITE,
+	driver:             "sqlite3",
+	has_schema_version: "SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'",
+	dsn: func(database string) string {
+		// Updates are handled concurrently. Take the write lock when a
+		// transaction begins, so two transactions never deadlock upgrading
+		// their read locks. This also serializes the migrations.
+		// In WAL mode, readers do not wait for the writer, and a commit
+		// needs no fsync but at checkpoints.
+		params := "_txlock=immediate&_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=" + strconv.Itoa(SQLITE_BUSY_TIMEOUT)
+		if strings.Contains(database, "?") {
+			return database + "&" + params
+		}
+		return database + "?" + params
+	},
+}
+
+// Milliseconds to wait for the write lock before failing with SQLITE_BUSY.
+const SQLITE_BUSY_TIMEOUT = 10000
+
+// Several bot processes may share one PostgreSQL database.
+var postgresDialect = &sqlDialect{
+	name:                STORAGE_POSTGRES,
+	driver:              "postgres",
+	dollar_placeholders: true,
+	has_schema_version:  "SELECT count(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_version'",
+	lock_migrations:     "SELECT pg_advisory_xact_lock(" + strconv.Itoa(POSTGRES_MIGRATION_LOCK) + ")",
+	skip_locked:         " FOR UPDATE SKIP LOCKED",
+	dsn: func(database string) string {
+		return database
+	},
+}
+
+// An arbitrary key for pg_advisory_xact_lock.
+const POSTGRES_MIGRATION_LOCK = 0x57545245
+
+func (d *sqlDialect) rebind(query string) string {
+	if !d.dollar_placeholders {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
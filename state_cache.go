@@ -0,0 +1,378 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Activity is recorded at most this often for each user,
+// which is plenty for expiring users idle for days.
+const ACTIVITY_RESOLUTION = time.Minute
+
+// The cache looks this often whether the users were changed behind its back.
+const STATE_VERSION_INTERVAL = time.Second
+
+// StateVersioner is implemented by the storages that can tell the cache
+// the users were changed by someone else, like the admin commands.
+type StateVersioner interface {
+	StateVersion() (version int64, err error)
+	BumpStateVersion() error
+}
+
+// stateCache keeps the state of users, their bans and the members of each
+// lobby in memory, in front of another storage, so forwarding a message
+// reads nothing from the database.
+//
+// Changes are written through, and the users a compound operation touches
+// are forgotten and loaded again on the next look. It assumes it is the
+// only process using the storage. The admin commands bump the state
+// version after changing users, and the cache drops everything within
+// STATE_VERSION_INTERVAL; Reset does it at once.
+// Administrators and processed update IDs are not cached.
+type stateCache struct {
+	Storage
+	clock Clock
+
+	// Held while changing users, so the cache sees the changes in the
+	// order the storage made them.
+	write_lock sync.Mutex
+
+	lock  sync.Mutex
+	users map[int64]UserStatus
+	// Members of the lobbies loaded so far.
+	lobbies map[int64]map[int64]struct{}
+	// Bumped on every change, so what was loaded before it is not kept.
+	generation uint64
+	// When the activity of each user was last recorded.
+	activity map[int64]time.Time
+	// The ban of each user, nil if not banned.
+	bans map[int64]*Ban
+
+	// The state version last seen, and when it was looked at.
+	version       int64
+	version_known bool
+	version_at    time.Time
+}
+
+func NewStateCache(storage Storage, clock Clock) *stateCache {
+	return &stateCache{
+		Storage:  storage,
+		clock:    clock,
+		users:    make(map[int64]UserStatus),
+		lobbies:  make(map[int64]map[int64]struct{}),
+		activity: make(map[int64]time.Time),
+		bans:     make(map[int64]*Ban),
+	}
+}
+
+// Reset drops everything cached.
+func (c *stateCache) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reset()
+}
+
+// Must be called with c.lock held.
+func (c *stateCache) reset() {
+	c.users = make(map[int64]UserStatus)
+	c.lobbies = make(map[int64]map[int64]struct{})
+	c.generation++
+	c.activity = make(map[int64]time.Time)
+	c.bans = make(map[int64]*Ban)
+}
+
+// revalidate drops everything if the state version has changed.
+// Only one caller looks at a time, the others go on with the cache.
+func (c *stateCache) revalidate() {
+	versioner, ok := c.Storage.(StateVersioner)
+	if !ok {
+		return
+	}
+	now := c.clock.Now()
+	c.lock.Lock()
+	if now.Sub(c.version_at) < STATE_VERSION_INTERVAL {
+		c.lock.Unlock()
+		return
+	}
+	c.version_at = now
+	c.lock.Unlock()
+
+	version, err := versioner.StateVersion()
+	if err != nil {
+		log.Printf("Error: %+v\n", err)
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.version_known && version != c.version {
+		log.Println("The users were changed elsewhere, dropped the cached state of users.")
+		c.reset()
+	}
+	c.version, c.version_known = version, true
+}
+
+// forget drops the users, whose new state is not known.
+// Must be called with c.lock held.
+func (c *stateCache) forget(users ...int64) {
+	for _, user := range users {
+		delete(c.users, user)
+	}
+	// They may have entered any lobby.
+	c.lobbies = make(map[int64]map[int64]struct{})
+	c.generation++
+}
+
+func (c *stateCache) GetUser(user int64) (status UserStatus, err error) {
+	c.revalidate()
+	c.lock.Lock()
+	status, ok := c.users[user]
+	generation := c.generation
+	c.lock.Unlock()
+	if ok {
+		return
+	}
+
+	status, err = c.Storage.GetUser(user)
+	if err != nil {
+		return
+	}
+	c.lock.Lock()
+	if c.generation == generation {
+		c.users[user] = status
+	}
+	c.lock.Unlock()
+	return
+}
+
+func (c *stateCache) TransitionUser(user int64, from UserState, to UserStatus) error {
+	c.write_lock.Lock()
+	defer c.write_lock.Unlock()
+	err := c.Storage.TransitionUser(user, from, to)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err != nil {
+		c.forget(user)
+		return err
+	}
+	for _, members := range c.lobbies {
+		delete(members, user)
+	}
+	if members, ok := c.lobbies[to.Room]; ok && to.State.InLobby() {
+		members[user] = struct{}{}
+	}
+	c.users[user] = to
+	c.generation++
+	return nil
+}
+
+func (c *stateCache) KickUser(user int64) (partner int64, err error) {
+	c.write_lock.Lock()
+	defer c.write_lock.Unlock()
+	partner, err = c.Storage.KickUser(user)
+
+	c.lock.Lock()
+	c.forget(user, partner)
+	c.lock.Unlock()
+	return
+}
+
+func (c *stateCache) LeaveChat(user_a int64) (user_b int64, err error) {
+	c.write_lock.Lock()
+	defer c.write_lock.Unlock()
+	user_b, err = c.Storage.LeaveChat(user_a)
+
+	c.lock.Lock()
+	c.forget(user_a, user_b)
+	c.lock.Unlock()
+	return
+}
+
+func (c *stateCache) ClaimInvitation(user_a int64, topic string) (user_b int64, err error) {
+	c.write_lock.Lock()
+	defer c.write_lock.Unlock()
+	user_b, err = c.Storage.ClaimInvitation(user_a, topic)
+
+	c.lock.Lock()
+	c.forget(user_a, user_b)
+	c.lock.Unlock()
+	return
+}
+
+func (c *stateCache) ListUsersInLobby(room int64) (users []int64, err error) {
+	c.revalidate()
+	c.lock.Lock()
+	members, ok := c.lobbies[room]
+	if ok {
+		users = make([]int64, 0, len(members))
+		for user := range members {
+			users = append(users, user)
+		}
+	}
+	generation := c.generation
+	c.lock.Unlock()
+	if ok {
+		return shuffleUsers(users), nil
+	}
+
+	users, err = c.Storage.ListUsersInLobby(room)
+	if err != nil {
+		return
+	}
+	c.lock.Lock()
+	if c.generation == generation {
+		members = make(map[int64]struct{}, len(users))
+		for _, user := range users {
+			members[user] = struct{}{}
+		}
+		c.lobbies[room] = members
+	}
+	c.lock.Unlock()
+	return
+}
+
+func (c *stateCache) RecordActivity(user int64, now time.Time) error {
+	c.lock.Lock()
+	recorded, ok := c.activity[user]
+	c.lock.Unlock()
+	if ok && now.Sub(recorded) < ACTIVITY_RESOLUTION {
+		return nil
+	}
+	err := c.Storage.RecordActivity(user, now)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.activity[user] = now
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *stateCache) ExpireIdleUsers(idle_since time.Time) (users []int64, err error) {
+	c.write_lock.Lock()
+	defer c.write_lock.Unlock()
+	users, err = c.Storage.ExpireIdleUsers(idle_since)
+	if err != nil {
+		c.Reset()
+		return
+	}
+
+	c.lock.Lock()
+	c.forget(users...)
+	c.lock.Unlock()
+	return
+}
+
+func (c *stateCache) BanUser(ban Ban) (partner int64, err error) {
+	c.write_lock.Lock()
+	defer c.write_lock.Unlock()
+	partner, err = c.Storage.BanUser(ban)
+
+	c.lock.Lock()
+	c.forget(ban.User, partner)
+	delete(c.bans, ban.User)
+	c.lock.Unlock()
+	return
+}
+
+func (c *stateCache) GetBan(user int64, now time.Time) (ban *Ban, err error) {
+	c.revalidate()
+	c.lock.Lock()
+	cached, ok := c.bans[user]
+	generation := c.generation
+	c.lock.Unlock()
+	// An expired ban is lifted by the storage.
+	if ok && (cached == nil || !cached.ExpiredAt(now)) {
+		return copyBan(cached), nil
+	}
+
+	ban, err = c.Storage.GetBan(user, now)
+	if err != nil {
+		return
+	}
+	c.lock.Lock()
+	if c.generation == generation {
+		c.bans[user] = copyBan(ban)
+	}
+	c.lock.Unlock()
+	return
+}
+
+func copyBan(ban *Ban) *Ban {
+	if ban == nil {
+		return nil
+	}
+	b := *ban
+	return &b
+}
+
+// changeBan runs a change to the ban of the user, then forgets it.
+func (c *stateCache) changeBan(user int64, change func() error) error {
+	c.write_lock.Lock()
+	defer c.write_lock.Unlock()
+	err := change()
+
+	c.lock.Lock()
+	delete(c.bans, user)
+	c.generation++
+	c.lock.Unlock()
+	return err
+}
+
+func (c *stateCache) RemoveFromBanList(user int64) error {
+	return c.changeBan(user, func() error {
+		return c.Storage.RemoveFromBanList(user)
+	})
+}
+
+func (c *stateCache) SetAppeal(user int64, created_at time.Time, from AppealState, to AppealState, text string) error {
+	return c.changeBan(user, func() error {
+		return c.Storage.SetAppeal(user, created_at, from, to, text)
+	})
+}
+
+func (c *stateCache) ResolveAppeal(user int64, created_at time.Time, approve bool) error {
+	return c.changeBan(user, func() error {
+		return c.Storage.ResolveAppeal(user, created_at, approve)
+	})
+}
+
+// Backup is passed on, so /backup still works with the cache.
+func (c *stateCache) Backup(path string) error {
+	backuper, ok := c.Storage.(Backuper)
+	if !ok {
+		return ErrBackupUnsupported
+	}
+	return backuper.Backup(path)
+}
+
+func (c *stateCache) Restore(path string) error {
+	backuper, ok := c.Storage.(Backuper)
+	if !ok {
+		return ErrBackupUnsupported
+	}
+	c.write_lock.Lock()
+	defer c.write_lock.Unlock()
+	err := backuper.Restore(path)
+	c.Reset()
+	return err
+}
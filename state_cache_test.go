@@ -0,0 +1,110 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSQLite(t *testing.T, path string) *dbManager {
+	conf := NewConfig()
+	conf.Database = path
+	dbm, err := NewDBManager(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dbm.CreateTables()
+	if err != nil {
+		dbm.Close()
+		t.Fatal(err)
+	}
+	return dbm
+}
+
+// The admin commands change the database directly, and the cache notices.
+func TestStateCacheSeesAdminChanges(t *testing.T) {
+	dbm := newTestSQLite(t, filepath.Join(t.TempDir(), "test.db"))
+	defer dbm.Close()
+	clock := NewFakeClock(time.Date(2017, 1, 1, 22, 0, 0, 0, time.UTC))
+	cache := NewStateCache(dbm, clock)
+	now := clock.Now()
+
+	startChat(t, cache, 1, 2)
+	expectUser(t, cache, 2, UserStatus{State: USER_CHATTING, Partner: 1})
+	ban, err := cache.GetBan(1, now)
+	if err != nil || ban != nil {
+		t.Fatalf("GetBan returned %+v, %v", ban, err)
+	}
+
+	cli := &adminCLI{dbm: dbm}
+	_, err = dbm.BanUser(Ban{User: 1, CreatedAt: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cli.changedUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Still cached until the version is looked at again.
+	expectUser(t, cache, 2, UserStatus{State: USER_CHATTING, Partner: 1})
+	clock.Advance(STATE_VERSION_INTERVAL)
+
+	expectUser(t, cache, 2, UserStatus{State: USER_CHATTING})
+	ban, err = cache.GetBan(1, now)
+	if err != nil || ban == nil {
+		t.Fatalf("GetBan returned %+v, %v", ban, err)
+	}
+}
+
+// Processed update IDs are written at once, so a crash does not
+// forget them.
+func TestStateCacheUpdates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	dbm := newTestSQLite(t, path)
+	defer dbm.Close()
+	cache := NewStateCache(dbm, NewRealClock())
+	for _, id := range []int{10, 11, 12} {
+		handled, err := cache.MarkUpdateReceived(id)
+		if err != nil || handled {
+			t.Fatalf("update #%d: handled = %v, %v", id, handled, err)
+		}
+	}
+	for _, id := range []int{10, 12} {
+		err := cache.MarkUpdateProcessed(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Another connection sees them before this one is closed.
+	other := newTestSQLite(t, path)
+	defer other.Close()
+	offset, err := other.GetUpdateOffset()
+	if err != nil || offset != 11 {
+		t.Fatalf("offset = %d, %v", offset, err)
+	}
+	for id, expected := range map[int]bool{10: true, 11: false, 12: true} {
+		handled, err := other.MarkUpdateReceived(id)
+		if err != nil || handled != expected {
+			t.Fatalf("update #%d: handled = %v, %v", id, handled, err)
+		}
+	}
+}
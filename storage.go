@@ -0,0 +1,98 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Storage keeps the state of every user.
+//
+// Every change of a user's state goes through TransitionUser, which
+// validates the move with checkUserTransition, or one of the compound
+// operations below, whose moves are fixed. Both fail with ErrStateChanged
+// if the user is not in the expected state.
+// The List functions return users in random order, except ListBans and ListAdmins.
+// Bans that have expired by now are lifted when they are looked at.
+type Storage interface {
+	Close() error
+	CreateTables() error
+
+	// Updates
+	GetUpdateOffset() (offset int, err error)
+	MarkUpdateReceived(id int) (handled bool, err error)
+	MarkUpdateProcessed(id int) error
+
+	// Users
+	GetUser(user int64) (status UserStatus, err error)
+	TransitionUser(user int64, from UserState, to UserStatus) error
+	KickUser(user int64) (partner int64, err error)
+	GetActiveUsers() (chat int, lobby int, err error)
+	ListAllUsers() (users []int64, err error)
+	RecordActivity(user int64, now time.Time) error
+	GetUserActivity(user int64) (activity UserActivity, err error)
+	ExpireIdleUsers(idle_since time.Time) (users []int64, err error)
+
+	// Chats
+	LeaveChat(user_a int64) (user_b int64, err error)
+	ListUnmatchedUsers() (users []int64, err error)
+
+	// Invitations
+	ClaimInvitation(user_a int64, topic string) (user_b int64, err error)
+	ListInvites() (topics []string, err error)
+
+	// Lobbies
+	ListUsersInLobby(room int64) (users []int64, err error)
+
+	// Administration
+	AddAdmin(user int64) error
+	RemoveAdmin(user int64) error
+	BanUser(ban Ban) (partner int64, err error)
+	RemoveFromBanList(user int64) error
+
+	// Status
+	IsUserAnAdmin(user int64) (ok bool, err error)
+	ListAdmins() (users []int64, err error)
+	GetBan(user int64, now time.Time) (ban *Ban, err error)
+	SetAppeal(user int64, created_at time.Time, from AppealState, to AppealState, text string) error
+	ResolveAppeal(user int64, created_at time.Time, approve bool) error
+	ListBans(now time.Time) (bans []Ban, err error)
+}
+
+const (
+	STORAGE_SQLITE   = "sqlite"
+	STORAGE_POSTGRES = "postgres"
+	STORAGE_MEMORY   = "memory"
+)
+
+func NewStorage(conf *Config) (Storage, error) {
+	switch conf.Storage {
+	case STORAGE_SQLITE, STORAGE_POSTGRES:
+		dbm, err := NewDBManager(conf)
+		if err != nil {
+			return nil, err
+		}
+		return dbm, nil
+	case STORAGE_MEMORY:
+		return NewMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage: %q", conf.Storage)
+	}
+}
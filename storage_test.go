@@ -0,0 +1,560 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testStorage struct {
+	name    string
+	storage string
+	cache   bool
+}
+
+// testStorages lists the storages scenarios run on, with and without the
+// cache. Every one must keep the same contract.
+func testStorages() (storages []testStorage) {
+	for _, storage := range scenarioStorages() {
+		storages = append(storages, testStorage{storage, storage, false})
+		// The bot refuses to cache PostgreSQL.
+		if storage != STORAGE_POSTGRES {
+			storages = append(storages, testStorage{"cache/" + storage, storage, true})
+		}
+	}
+	return
+}
+
+func newTestStorage(t *testing.T, storage string, cache bool) Storage {
+	conf := NewConfig()
+	conf.Storage = storage
+	dir := t.TempDir()
+	conf.Database = filepath.Join(dir, "test.db")
+	if storage == STORAGE_POSTGRES {
+		var err error
+		conf.Database, err = createScenarioSchema(filepath.Base(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { dropScenarioSchema(filepath.Base(dir)) })
+	}
+	dbm, err := NewStorage(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbm.Close() })
+	err = dbm.CreateTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache {
+		return NewStateCache(dbm, NewRealClock())
+	}
+	return dbm
+}
+
+func TestStorage(t *testing.T) {
+	for _, ts := range testStorages() {
+		t.Run(ts.name, func(t *testing.T) {
+			for _, tc := range storageTests {
+				t.Run(tc.name, func(t *testing.T) {
+					tc.run(t, newTestStorage(t, ts.storage, ts.cache))
+				})
+			}
+		})
+	}
+}
+
+var storageTests = []struct {
+	name string
+	run  func(t *testing.T, dbm Storage)
+}{
+	{"transition", testTransition},
+	{"claim invitation", testClaimInvitation},
+	{"kick user", testKickUser},
+	{"leave chat", testLeaveChat},
+	{"list unmatched users", testListUnmatchedUsers},
+	{"list users in lobby", testListUsersInLobby},
+	{"expire idle users", testExpireIdleUsers},
+	{"ban user", testBanUser},
+	{"ban expiry", testBanExpiry},
+	{"appeal", testAppeal},
+	{"admins", testAdmins},
+	{"updates", testUpdates},
+	{"outbox", testOutbox},
+}
+
+// mustTransition moves the user through the states in order,
+// starting from USER_DISCONNECTED.
+func mustTransition(t *testing.T, dbm Storage, user int64, to ...UserStatus) {
+	t.Helper()
+	from := USER_DISCONNECTED
+	for _, status := range to {
+		err := dbm.TransitionUser(user, from, status)
+		if err != nil {
+			t.Fatalf("#%d %v -> %v: %v", user, from, status.State, err)
+		}
+		from = status.State
+	}
+}
+
+func expectUser(t *testing.T, dbm Storage, user int64, want UserStatus) {
+	t.Helper()
+	status, err := dbm.GetUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != want {
+		t.Fatalf("#%d is %+v, want %+v", user, status, want)
+	}
+}
+
+// expectUsers checks the users listed, in any order.
+func expectUsers(t *testing.T, users []int64, err error, want ...int64) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i] < users[j]
+	})
+	if len(users) != len(want) {
+		t.Fatalf("listed %v, want %v", users, want)
+	}
+	for i := range users {
+		if users[i] != want[i] {
+			t.Fatalf("listed %v, want %v", users, want)
+		}
+	}
+}
+
+// startChat puts both users in a chat through an invitation.
+func startChat(t *testing.T, dbm Storage, user_a int64, user_b int64) {
+	t.Helper()
+	mustTransition(t, dbm, user_a, UserStatus{State: USER_LOBBY}, UserStatus{State: USER_WAITING, Topic: "聊聊天"})
+	mustTransition(t, dbm, user_b, UserStatus{State: USER_LOBBY})
+	partner, err := dbm.ClaimInvitation(user_b, "聊聊天")
+	if err != nil || partner != user_a {
+		t.Fatalf("ClaimInvitation returned %d, %v", partner, err)
+	}
+}
+
+func testTransition(t *testing.T, dbm Storage) {
+	mustTransition(t, dbm, 1, UserStatus{State: USER_LOBBY})
+	expectUser(t, dbm, 1, UserStatus{State: USER_LOBBY})
+
+	err := dbm.TransitionUser(1, USER_DISCONNECTED, UserStatus{State: USER_LOBBY})
+	if !errors.Is(err, ErrStateChanged) {
+		t.Fatalf("from the wrong state: %v", err)
+	}
+	err = dbm.TransitionUser(2, USER_DISCONNECTED, UserStatus{State: USER_CHATTING})
+	if !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("invalid transition: %v", err)
+	}
+	expectUser(t, dbm, 2, UserStatus{})
+}
+
+// Many users claim the same invitation at once, only one of them wins.
+func testClaimInvitation(t *testing.T, dbm Storage) {
+	const inviter, claimants = 1, 20
+	mustTransition(t, dbm, inviter, UserStatus{State: USER_LOBBY}, UserStatus{State: USER_WAITING, Topic: "聊聊天"})
+	for user := int64(2); user < 2+claimants; user++ {
+		mustTransition(t, dbm, user, UserStatus{State: USER_LOBBY})
+	}
+
+	partners := make([]int64, claimants)
+	errs := make([]error, claimants)
+	var wg sync.WaitGroup
+	for i := range partners {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			partners[i], errs[i] = dbm.ClaimInvitation(int64(2+i), "聊聊天")
+		}(i)
+	}
+	wg.Wait()
+
+	winner := int64(0)
+	for i, err := range errs {
+		user := int64(2 + i)
+		switch {
+		case err == nil:
+			if winner != 0 {
+				t.Fatalf("both #%d and #%d claimed the invitation", winner, user)
+			}
+			if partners[i] != inviter {
+				t.Fatalf("#%d was paired with #%d", user, partners[i])
+			}
+			winner = user
+		case errors.Is(err, ErrInvitationTaken):
+			expectUser(t, dbm, user, UserStatus{State: USER_LOBBY})
+		default:
+			t.Fatalf("#%d: %v", user, err)
+		}
+	}
+	if winner == 0 {
+		t.Fatal("nobody claimed the invitation")
+	}
+	expectUser(t, dbm, inviter, UserStatus{State: USER_CHATTING, Partner: winner})
+	expectUser(t, dbm, winner, UserStatus{State: USER_CHATTING, Partner: inviter})
+
+	invites, err := dbm.ListInvites()
+	if err != nil || len(invites) != 0 {
+		t.Fatalf("invitations left: %v, %v", invites, err)
+	}
+}
+
+func testKickUser(t *testing.T, dbm Storage) {
+	startChat(t, dbm, 1, 2)
+	partner, err := dbm.KickUser(1)
+	if err != nil || partner != 2 {
+		t.Fatalf("KickUser returned %d, %v", partner, err)
+	}
+	expectUser(t, dbm, 1, UserStatus{State: USER_DISCONNECTED})
+	// The partner stays, and finds out the other side has left.
+	expectUser(t, dbm, 2, UserStatus{State: USER_CHATTING})
+
+	partner, err = dbm.KickUser(2)
+	if err != nil || partner != 0 {
+		t.Fatalf("KickUser returned %d, %v", partner, err)
+	}
+	expectUser(t, dbm, 2, UserStatus{State: USER_DISCONNECTED})
+}
+
+func testLeaveChat(t *testing.T, dbm Storage) {
+	startChat(t, dbm, 1, 2)
+	partner, err := dbm.LeaveChat(2)
+	if err != nil || partner != 1 {
+		t.Fatalf("LeaveChat returned %d, %v", partner, err)
+	}
+	expectUser(t, dbm, 2, UserStatus{State: USER_LOBBY})
+	expectUser(t, dbm, 1, UserStatus{State: USER_CHATTING})
+
+	_, err = dbm.LeaveChat(2)
+	if !errors.Is(err, ErrStateChanged) {
+		t.Fatalf("leaving twice: %v", err)
+	}
+	partner, err = dbm.LeaveChat(1)
+	if err != nil || partner != 0 {
+		t.Fatalf("LeaveChat returned %d, %v", partner, err)
+	}
+	expectUser(t, dbm, 1, UserStatus{State: USER_LOBBY})
+}
+
+// The users who see new invitations: everyone in the lobby, and those
+// whose partner has left.
+func testListUnmatchedUsers(t *testing.T, dbm Storage) {
+	startChat(t, dbm, 1, 2)
+	startChat(t, dbm, 3, 4)
+	_, err := dbm.LeaveChat(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustTransition(t, dbm, 5, UserStatus{State: USER_LOBBY}, UserStatus{State: USER_TYPING_TOPIC})
+	mustTransition(t, dbm, 6, UserStatus{State: USER_LOBBY}, UserStatus{State: USER_WAITING, Topic: "散步"})
+	mustTransition(t, dbm, 7, UserStatus{State: USER_LOBBY}, UserStatus{State: USER_DISCONNECTED})
+
+	users, err := dbm.ListUnmatchedUsers()
+	expectUsers(t, users, err, 3, 4, 5, 6)
+}
+
+func testListUsersInLobby(t *testing.T, dbm Storage) {
+	mustTransition(t, dbm, 1, UserStatus{State: USER_LOBBY})
+	mustTransition(t, dbm, 2, UserStatus{State: USER_LOBBY, Room: 1})
+	mustTransition(t, dbm, 3, UserStatus{State: USER_LOBBY}, UserStatus{State: USER_WAITING, Topic: "散步"})
+	startChat(t, dbm, 4, 5)
+	mustTransition(t, dbm, 6, UserStatus{State: USER_LOBBY}, UserStatus{State: USER_DISCONNECTED})
+
+	users, err := dbm.ListUsersInLobby(0)
+	expectUsers(t, users, err, 1, 3)
+	users, err = dbm.ListUsersInLobby(1)
+	expectUsers(t, users, err, 2)
+
+	// Moving between lobbies is seen by both.
+	err = dbm.TransitionUser(1, USER_LOBBY, UserStatus{State: USER_LOBBY, Room: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err = dbm.ListUsersInLobby(0)
+	expectUsers(t, users, err, 3)
+	users, err = dbm.ListUsersInLobby(1)
+	expectUsers(t, users, err, 1, 2)
+}
+
+// Only the users idle in the lobby are disconnected, not those chatting.
+func testExpireIdleUsers(t *testing.T, dbm Storage) {
+	now := time.Date(2017, 1, 8, 22, 0, 0, 0, time.UTC)
+	long_ago := now.Add(-8 * 24 * time.Hour)
+	mustTransition(t, dbm, 1, UserStatus{State: USER_LOBBY})
+	mustTransition(t, dbm, 2, UserStatus{State: USER_LOBBY})
+	mustTransition(t, dbm, 3, UserStatus{State: USER_LOBBY, Room: 1}, UserStatus{State: USER_WAITING, Room: 1, Topic: "散步"})
+	startChat(t, dbm, 4, 5)
+	for user, at := range map[int64]time.Time{1: long_ago, 2: now, 3: long_ago, 4: long_ago, 5: long_ago} {
+		err := dbm.RecordActivity(user, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Older activity does not count.
+	err := dbm.RecordActivity(2, long_ago)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activity, err := dbm.GetUserActivity(2)
+	if err != nil || !activity.LastActive.Equal(now) {
+		t.Fatalf("GetUserActivity returned %+v, %v", activity, err)
+	}
+	// Someone new is first seen when first active.
+	err = dbm.RecordActivity(8, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activity, err = dbm.GetUserActivity(8)
+	if err != nil || !activity.FirstSeen.Equal(now) || !activity.LastActive.Equal(now) {
+		t.Fatalf("GetUserActivity returned %+v, %v", activity, err)
+	}
+
+	users, err := dbm.ExpireIdleUsers(now.Add(-7 * 24 * time.Hour))
+	expectUsers(t, users, err, 1, 3)
+	expectUser(t, dbm, 1, UserStatus{State: USER_DISCONNECTED})
+	expectUser(t, dbm, 3, UserStatus{State: USER_DISCONNECTED, Room: 1})
+	expectUser(t, dbm, 2, UserStatus{State: USER_LOBBY})
+	expectUser(t, dbm, 4, UserStatus{State: USER_CHATTING, Partner: 5})
+	users, err = dbm.ListUsersInLobby(0)
+	expectUsers(t, users, err, 2)
+}
+
+func testBanUser(t *testing.T, dbm Storage) {
+	now := time.Date(2017, 1, 1, 22, 0, 0, 0, time.UTC)
+	startChat(t, dbm, 1, 2)
+	partner, err := dbm.BanUser(Ban{User: 2, Reason: "刷屏", CreatedAt: now})
+	if err != nil || partner != 1 {
+		t.Fatalf("BanUser returned %d, %v", partner, err)
+	}
+	expectUser(t, dbm, 2, UserStatus{State: USER_DISCONNECTED})
+	expectUser(t, dbm, 1, UserStatus{State: USER_CHATTING})
+
+	ban, err := dbm.GetBan(2, now)
+	if err != nil || ban == nil || ban.Reason != "刷屏" || !ban.Permanent() {
+		t.Fatalf("GetBan returned %+v, %v", ban, err)
+	}
+	ban, err = dbm.GetBan(1, now)
+	if err != nil || ban != nil {
+		t.Fatalf("GetBan returned %+v, %v", ban, err)
+	}
+
+	err = dbm.RemoveFromBanList(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ban, err = dbm.GetBan(2, now)
+	if err != nil || ban != nil {
+		t.Fatalf("GetBan returned %+v, %v", ban, err)
+	}
+}
+
+// A ban is lifted once it has expired, whoever looks at it.
+func testBanExpiry(t *testing.T, dbm Storage) {
+	now := time.Date(2017, 1, 1, 22, 0, 0, 0, time.UTC)
+	for _, user := range []int64{1, 2} {
+		_, err := dbm.BanUser(Ban{User: user, Reason: "刷屏", CreatedAt: now, ExpiresAt: now.Add(2 * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ban, err := dbm.GetBan(1, now.Add(time.Hour))
+	if err != nil || ban == nil || ban.Permanent() || !ban.ExpiresAt.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("GetBan returned %+v, %v", ban, err)
+	}
+	bans, err := dbm.ListBans(now.Add(time.Hour))
+	if err != nil || len(bans) != 2 || bans[0].User != 1 || bans[1].User != 2 {
+		t.Fatalf("ListBans returned %+v, %v", bans, err)
+	}
+
+	ban, err = dbm.GetBan(1, now.Add(2*time.Hour))
+	if err != nil || ban != nil {
+		t.Fatalf("GetBan returned %+v, %v", ban, err)
+	}
+	bans, err = dbm.ListBans(now.Add(2 * time.Hour))
+	if err != nil || len(bans) != 0 {
+		t.Fatalf("ListBans returned %+v, %v", bans, err)
+	}
+	// Lifted, not just hidden.
+	ban, err = dbm.GetBan(1, now)
+	if err != nil || ban != nil {
+		t.Fatalf("GetBan returned %+v, %v", ban, err)
+	}
+}
+
+func testAppeal(t *testing.T, dbm Storage) {
+	now := time.Date(2017, 1, 1, 22, 0, 0, 0, time.UTC)
+	for _, user := range []int64{1, 2} {
+		_, err := dbm.BanUser(Ban{User: user, Reason: "刷屏", CreatedAt: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dbm.SetAppeal(user, now, APPEAL_NONE, APPEAL_PENDING, "我没有刷屏")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ban, err := dbm.GetBan(1, now)
+	if err != nil || ban == nil || ban.Appeal != APPEAL_PENDING || ban.AppealText != "我没有刷屏" {
+		t.Fatalf("GetBan returned %+v, %v", ban, err)
+	}
+
+	// From the wrong state, or for another ban.
+	err = dbm.SetAppeal(1, now, APPEAL_NONE, APPEAL_PENDING, "")
+	if !errors.Is(err, ErrStateChanged) {
+		t.Fatalf("appealing twice: %v", err)
+	}
+	err = dbm.ResolveAppeal(1, now.Add(time.Second), true)
+	if !errors.Is(err, ErrStateChanged) {
+		t.Fatalf("resolving another ban: %v", err)
+	}
+
+	err = dbm.ResolveAppeal(1, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ban, err = dbm.GetBan(1, now)
+	if err != nil || ban == nil || ban.Appeal != APPEAL_REJECTED {
+		t.Fatalf("GetBan returned %+v, %v", ban, err)
+	}
+	err = dbm.ResolveAppeal(1, now, true)
+	if !errors.Is(err, ErrStateChanged) {
+		t.Fatalf("resolving twice: %v", err)
+	}
+
+	err = dbm.ResolveAppeal(2, now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ban, err = dbm.GetBan(2, now)
+	if err != nil || ban != nil {
+		t.Fatalf("GetBan returned %+v, %v", ban, err)
+	}
+}
+
+func testAdmins(t *testing.T, dbm Storage) {
+	for _, user := range []int64{3, 1, 3} {
+		err := dbm.AddAdmin(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	admins, err := dbm.ListAdmins()
+	if err != nil || len(admins) != 2 || admins[0] != 1 || admins[1] != 3 {
+		t.Fatalf("ListAdmins returned %v, %v", admins, err)
+	}
+	ok, err := dbm.IsUserAnAdmin(2)
+	if err != nil || ok {
+		t.Fatalf("IsUserAnAdmin returned %v, %v", ok, err)
+	}
+
+	err = dbm.RemoveAdmin(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = dbm.IsUserAnAdmin(3)
+	if err != nil || ok {
+		t.Fatalf("IsUserAnAdmin returned %v, %v", ok, err)
+	}
+	admins, err = dbm.ListAdmins()
+	if err != nil || len(admins) != 1 || admins[0] != 1 {
+		t.Fatalf("ListAdmins returned %v, %v", admins, err)
+	}
+}
+
+// The offset is the first update received but not handled.
+func testUpdates(t *testing.T, dbm Storage) {
+	expectOffset := func(want int) {
+		t.Helper()
+		offset, err := dbm.GetUpdateOffset()
+		if err != nil || offset != want {
+			t.Fatalf("offset = %d, %v, want %d", offset, err, want)
+		}
+	}
+	expectOffset(0)
+	for _, id := range []int{5, 6, 7} {
+		handled, err := dbm.MarkUpdateReceived(id)
+		if err != nil || handled {
+			t.Fatalf("update #%d: handled = %v, %v", id, handled, err)
+		}
+	}
+	expectOffset(5)
+	for _, id := range []int{5, 7} {
+		err := dbm.MarkUpdateProcessed(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectOffset(6)
+
+	for id, want := range map[int]bool{5: true, 6: false, 7: true} {
+		handled, err := dbm.MarkUpdateReceived(id)
+		if err != nil || handled != want {
+			t.Fatalf("update #%d: handled = %v, %v", id, handled, err)
+		}
+	}
+	err := dbm.MarkUpdateProcessed(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectOffset(8)
+}
+
+func testOutbox(t *testing.T, dbm Storage) {
+	outbox, ok := dbm.(Outbox)
+	if !ok {
+		t.Skip("no outbox")
+	}
+	entries := []OutboxEntry{
+		{Priority: QUEUE_PRIORITY_HIGH, Kind: "MessageConfig", Body: `{"a":1}`},
+		{Priority: QUEUE_PRIORITY_LOW, Kind: "ForwardConfig", Body: `{"b":2}`},
+		{Priority: QUEUE_PRIORITY_NORMAL, Kind: "MessageConfig", Body: `{"c":3}`},
+	}
+	err := outbox.AddToOutbox(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].ID <= entries[i-1].ID {
+			t.Fatalf("IDs not in order: %+v", entries)
+		}
+	}
+
+	err = outbox.RemoveFromOutbox(entries[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed, err := outbox.ListOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0] != entries[0] || listed[1] != entries[2] {
+		t.Fatalf("ListOutbox returned %+v", listed)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Transport is everything the bot needs from the Telegram Bot API.
+type Transport interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	AnswerCallbackQuery(config tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error)
+	// GetUpdates starts receiving updates, beginning with offset.
+	GetUpdates(offset int) (<-chan tgbotapi.Update, error)
+	// StopUpdates stops receiving updates.
+	// Updates already in the channel can still be read.
+	StopUpdates(ctx context.Context) error
+}
+
+type telegramTransport struct {
+	api     *tgbotapi.BotAPI
+	conf    *Config
+	webhook *webhookServer
+}
+
+func NewTelegramTransport(conf *Config) (*telegramTransport, error) {
+	api, err := tgbotapi.NewBotAPI(conf.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return &telegramTransport{
+		api:  api,
+		conf: conf,
+	}, nil
+}
+
+func (t *telegramTransport) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	return t.api.Send(c)
+}
+
+func (t *telegramTransport) AnswerCallbackQuery(config tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error) {
+	return t.api.AnswerCallbackQuery(config)
+}
+
+func (t *telegramTransport) GetUpdates(offset int) (updates <-chan tgbotapi.Update, err error) {
+	if t.conf.Webhook != nil {
+		t.webhook, err = NewWebhookServer(t.conf.Webhook, t.api)
+		if err != nil {
+			return
+		}
+		updates = t.webhook.Updates()
+		return
+	}
+
+	// getUpdates does not work while a webhook is set.
+	_, err = t.api.RemoveWebhook()
+	if err != nil {
+		return
+	}
+	log.Printf("Resuming from update #%d\n", offset)
+	u := tgbotapi.NewUpdate(offset)
+	u.Timeout = 60
+	return t.api.GetUpdatesChan(u)
+}
+
+func (t *telegramTransport) StopUpdates(ctx context.Context) error {
+	if t.webhook != nil {
+		return t.webhook.Shutdown(ctx)
+	}
+	t.api.StopReceivingUpdates()
+	return nil
+}
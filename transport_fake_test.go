@@ -0,0 +1,98 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// fakeTransport never talks to Telegram.
+// It records everything the bot sends, so handlers can be tested offline.
+type fakeTransport struct {
+	lock     sync.Mutex
+	sent     []tgbotapi.Chattable
+	answered []tgbotapi.CallbackConfig
+	// Errors to return, once each, for the next messages to each chat.
+	next_errors map[int64][]error
+	last_id     int
+	updates     chan tgbotapi.Update
+}
+
+func NewFakeTransport() *fakeTransport {
+	return &fakeTransport{
+		next_errors: make(map[int64][]error),
+		updates:     make(chan tgbotapi.Update, 100),
+	}
+}
+
+func (t *fakeTransport) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	chat_id, err := recipientOf(c)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if errs := t.next_errors[chat_id]; len(errs) != 0 {
+		t.next_errors[chat_id] = errs[1:]
+		return tgbotapi.Message{}, errs[0]
+	}
+	t.sent = append(t.sent, c)
+	t.last_id++
+	return tgbotapi.Message{
+		MessageID: t.last_id,
+		Chat:      &tgbotapi.Chat{ID: chat_id},
+	}, nil
+}
+
+func (t *fakeTransport) AnswerCallbackQuery(config tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.answered = append(t.answered, config)
+	return tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func (t *fakeTransport) GetUpdates(offset int) (<-chan tgbotapi.Update, error) {
+	return t.updates, nil
+}
+
+func (t *fakeTransport) StopUpdates(ctx context.Context) error {
+	return nil
+}
+
+// FailNext makes the next message to chat_id fail with err,
+// once for each time it is called.
+func (t *fakeTransport) FailNext(chat_id int64, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.next_errors[chat_id] = append(t.next_errors[chat_id], err)
+}
+
+func (t *fakeTransport) SentTo(chat_id int64) (sent []tgbotapi.Chattable) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, c := range t.sent {
+		if chat, _ := recipientOf(c); chat == chat_id {
+			sent = append(sent, c)
+		}
+	}
+	return
+}
@@ -0,0 +1,191 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// How often the pool logs its queue wait time.
+const UPDATE_STATS_INTERVAL = 10 * time.Minute
+
+// updatePool handles updates on several workers.
+// Updates from the same chat are handled one at a time, in the order received.
+type updatePool struct {
+	clock   Clock
+	handle  func(update *tgbotapi.Update)
+	lock    sync.Mutex
+	cv      *sync.Cond
+	pending map[int64]*list.List
+	busy    map[int64]bool
+	// Chats with pending updates and no worker on them.
+	ready   *list.List
+	closing bool
+	workers sync.WaitGroup
+	stats   UpdatePoolStats
+}
+
+type updatePoolItem struct {
+	update   *tgbotapi.Update
+	received time.Time
+}
+
+// UpdatePoolStats counts since the last time they were taken.
+type UpdatePoolStats struct {
+	Processed int
+	Pending   int
+	WaitTotal time.Duration
+	WaitMax   time.Duration
+}
+
+func NewUpdatePool(clock Clock, workers int, handle func(update *tgbotapi.Update)) *updatePool {
+	p := &updatePool{
+		clock:   clock,
+		handle:  handle,
+		pending: make(map[int64]*list.List),
+		busy:    make(map[int64]bool),
+		ready:   list.New(),
+	}
+	p.cv = sync.NewCond(&p.lock)
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// updateChatID returns the chat an update belongs to, or 0 if unknown.
+func updateChatID(update *tgbotapi.Update) int64 {
+	switch {
+	case update.Message != nil && update.Message.Chat != nil:
+		return update.Message.Chat.ID
+	case update.EditedMessage != nil && update.EditedMessage.Chat != nil:
+		return update.EditedMessage.Chat.ID
+	case update.CallbackQuery != nil && update.CallbackQuery.Message != nil && update.CallbackQuery.Message.Chat != nil:
+		return update.CallbackQuery.Message.Chat.ID
+	case update.CallbackQuery != nil && update.CallbackQuery.From != nil:
+		return int64(update.CallbackQuery.From.ID)
+	default:
+		return 0
+	}
+}
+
+func (p *updatePool) Submit(update *tgbotapi.Update) {
+	chat_id := updateChatID(update)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	queue, ok := p.pending[chat_id]
+	if !ok {
+		queue = list.New()
+		p.pending[chat_id] = queue
+	}
+	queue.PushBack(&updatePoolItem{
+		update:   update,
+		received: p.clock.Now(),
+	})
+	if queue.Len() == 1 && !p.busy[chat_id] {
+		p.ready.PushBack(chat_id)
+		p.cv.Signal()
+	}
+}
+
+func (p *updatePool) work() {
+	defer p.workers.Done()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for {
+		for p.ready.Len() == 0 && !p.closing {
+			p.cv.Wait()
+		}
+		if p.ready.Len() == 0 {
+			return
+		}
+
+		chat_id := p.ready.Remove(p.ready.Front()).(int64)
+		queue := p.pending[chat_id]
+		item := queue.Remove(queue.Front()).(*updatePoolItem)
+		p.busy[chat_id] = true
+
+		wait := p.clock.Now().Sub(item.received)
+		p.stats.Processed++
+		p.stats.WaitTotal += wait
+		if wait > p.stats.WaitMax {
+			p.stats.WaitMax = wait
+		}
+
+		p.lock.Unlock()
+		p.handle(item.update)
+		p.lock.Lock()
+
+		delete(p.busy, chat_id)
+		if queue.Len() != 0 {
+			// Back of the line, so one busy chat cannot starve the others.
+			p.ready.PushBack(chat_id)
+			p.cv.Signal()
+		} else {
+			delete(p.pending, chat_id)
+		}
+	}
+}
+
+// TakeStats returns the statistics and starts counting again.
+func (p *updatePool) TakeStats() (stats UpdatePoolStats) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	stats = p.stats
+	for _, queue := range p.pending {
+		stats.Pending += queue.Len()
+	}
+	p.stats = UpdatePoolStats{}
+	return
+}
+
+// LogStats logs the statistics every interval until stop is closed.
+func (p *updatePool) LogStats(interval time.Duration, stop <-chan struct{}) {
+	for {
+		select {
+		case <-p.clock.After(interval):
+		case <-stop:
+			return
+		}
+		stats := p.TakeStats()
+		if stats.Processed == 0 && stats.Pending == 0 {
+			continue
+		}
+		var average time.Duration
+		if stats.Processed != 0 {
+			average = stats.WaitTotal / time.Duration(stats.Processed)
+		}
+		log.Printf("Updates: %d processed, %d pending, waited %v on average, %v at most\n", stats.Processed, stats.Pending, average, stats.WaitMax)
+	}
+}
+
+// Close handles every update already submitted, then stops the workers.
+func (p *updatePool) Close() {
+	p.lock.Lock()
+	p.closing = true
+	p.cv.Broadcast()
+	p.lock.Unlock()
+	p.workers.Wait()
+}
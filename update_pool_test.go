@@ -0,0 +1,135 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	POOL_TEST_WORKERS = 8
+	POOL_TEST_CHATS   = 10
+	POOL_TEST_UPDATES = 200
+)
+
+func newPoolTestUpdate(update_id int, chat_id int64) *tgbotapi.Update {
+	return &tgbotapi.Update{
+		UpdateID: update_id,
+		Message:  &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: chat_id}},
+	}
+}
+
+// Updates for several chats come in mixed together, and each chat gets
+// its own in the order they came, one at a time.
+func TestUpdatePoolOrder(t *testing.T) {
+	var lock sync.Mutex
+	handled := make(map[int64][]int)
+	running := make(map[int64]bool)
+	busy, max_busy := 0, 0
+	pool := NewUpdatePool(NewFakeClock(time.Now()), POOL_TEST_WORKERS, func(update *tgbotapi.Update) {
+		chat_id := updateChatID(update)
+		lock.Lock()
+		if running[chat_id] {
+			t.Errorf("two updates of #%d at once", chat_id)
+		}
+		running[chat_id] = true
+		busy++
+		if busy > max_busy {
+			max_busy = busy
+		}
+		lock.Unlock()
+
+		runtime.Gosched()
+
+		lock.Lock()
+		handled[chat_id] = append(handled[chat_id], update.UpdateID)
+		running[chat_id] = false
+		busy--
+		lock.Unlock()
+	})
+
+	var submitters sync.WaitGroup
+	next_id := 0
+	var id_lock sync.Mutex
+	for i := 0; i < POOL_TEST_CHATS; i++ {
+		submitters.Add(1)
+		go func(chat_id int64) {
+			defer submitters.Done()
+			for j := 0; j < POOL_TEST_UPDATES; j++ {
+				// The IDs go up in the order submitted, as from Telegram.
+				id_lock.Lock()
+				next_id++
+				pool.Submit(newPoolTestUpdate(next_id, chat_id))
+				id_lock.Unlock()
+			}
+		}(int64(1001 + i))
+	}
+	submitters.Wait()
+	pool.Close()
+
+	for i := 0; i < POOL_TEST_CHATS; i++ {
+		chat_id := int64(1001 + i)
+		ids := handled[chat_id]
+		if len(ids) != POOL_TEST_UPDATES {
+			t.Fatalf("#%d got %d updates, expected %d", chat_id, len(ids), POOL_TEST_UPDATES)
+		}
+		for j := 1; j < len(ids); j++ {
+			if ids[j] <= ids[j-1] {
+				t.Fatalf("#%d got update %d after %d", chat_id, ids[j], ids[j-1])
+			}
+		}
+	}
+	t.Logf("up to %d chats handled at once", max_busy)
+}
+
+// A chat slow to handle does not hold up the others.
+func TestUpdatePoolConcurrent(t *testing.T) {
+	other_started := make(chan struct{})
+	var lock sync.Mutex
+	var handled []int
+	pool := NewUpdatePool(NewFakeClock(time.Now()), 2, func(update *tgbotapi.Update) {
+		if update.UpdateID == 1 {
+			select {
+			case <-other_started:
+			case <-time.After(SCENARIO_SETTLE_TIMEOUT):
+				t.Error("the other chat waited for the slow one")
+			}
+		} else if update.UpdateID == 3 {
+			close(other_started)
+		}
+		lock.Lock()
+		handled = append(handled, update.UpdateID)
+		lock.Unlock()
+	})
+	// The slow chat has another update waiting behind the first,
+	// which must not take the second worker.
+	pool.Submit(newPoolTestUpdate(1, 1001))
+	pool.Submit(newPoolTestUpdate(2, 1001))
+	pool.Submit(newPoolTestUpdate(3, 1002))
+	pool.Close()
+
+	if len(handled) != 3 || handled[0] != 3 || handled[1] != 1 || handled[2] != 2 {
+		t.Fatalf("handled %v, expected [3 1 2]", handled)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type UserState int
+
+// The values are stored in the database, do not renumber.
+const (
+	USER_DISCONNECTED UserState = 0
+	// In the lobby, receiving lobby messages.
+	USER_LOBBY UserState = 1
+	// In the lobby, the next message will be the topic of an invitation.
+	USER_TYPING_TOPIC UserState = 2
+	// In the lobby, with an invitation waiting for someone to join.
+	USER_WAITING UserState = 3
+	// In a private chat. Partner is 0 if the other side has left.
+	USER_CHATTING UserState = 4
+)
+
+// UserStatus is one row in the users table.
+// Room is meaningful in the lobby states, Topic in USER_WAITING,
+// and Partner in USER_CHATTING.
+type UserStatus struct {
+	State   UserState
+	Room    int64
+	Topic   string
+	Partner int64
+}
+
+// UserActivity is when the user was first and last heard from.
+// FirstSeen is zero for the users from before it was recorded.
+type UserActivity struct {
+	FirstSeen  time.Time
+	LastActive time.Time
+}
+
+var (
+	ErrInvalidTransition = errors.New("invalid user state transition")
+	// The user is no longer in the state the caller expected,
+	// another update got there first.
+	ErrStateChanged = errors.New("user state has changed")
+	// Somebody else has answered the invitation, or it was withdrawn.
+	ErrInvitationTaken = errors.New("invitation already taken")
+)
+
+var userTransitions = map[UserState][]UserState{
+	USER_DISCONNECTED: {USER_LOBBY},
+	USER_LOBBY:        {USER_DISCONNECTED, USER_LOBBY, USER_TYPING_TOPIC, USER_WAITING, USER_CHATTING},
+	USER_TYPING_TOPIC: {USER_DISCONNECTED, USER_LOBBY, USER_WAITING, USER_CHATTING},
+	USER_WAITING:      {USER_DISCONNECTED, USER_LOBBY, USER_TYPING_TOPIC, USER_WAITING, USER_CHATTING},
+	USER_CHATTING:     {USER_DISCONNECTED, USER_LOBBY},
+}
+
+func (state UserState) String() string {
+	switch state {
+	case USER_DISCONNECTED:
+		return "disconnected"
+	case USER_LOBBY:
+		return "lobby"
+	case USER_TYPING_TOPIC:
+		return "typing-topic"
+	case USER_WAITING:
+		return "waiting"
+	case USER_CHATTING:
+		return "chatting"
+	default:
+		return fmt.Sprintf("UserState(%d)", int(state))
+	}
+}
+
+// InLobby reports whether the user receives lobby messages.
+func (state UserState) InLobby() bool {
+	return state == USER_LOBBY || state == USER_TYPING_TOPIC || state == USER_WAITING
+}
+
+func checkUserTransition(from UserState, to UserState) error {
+	for _, allowed := range userTransitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %v -> %v", ErrInvalidTransition, from, to)
+}
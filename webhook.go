@@ -0,0 +1,132 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Telegram limits an update to a few megabytes, leave some room.
+const WEBHOOK_MAX_BODY = 16 << 20
+
+const WEBHOOK_SECRET_HEADER = "X-Telegram-Bot-Api-Secret-Token"
+
+type webhookServer struct {
+	conf    *WebhookConfig
+	server  *http.Server
+	updates chan tgbotapi.Update
+}
+
+func NewWebhookServer(conf *WebhookConfig, api *tgbotapi.BotAPI) (ws *webhookServer, err error) {
+	ws = &webhookServer{
+		conf:    conf,
+		updates: make(chan tgbotapi.Update, api.Buffer),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(conf.Path, ws.handleUpdate)
+	ws.server = &http.Server{
+		Addr:              conf.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	err = ws.register(api)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		var err error
+		if conf.CertFile != "" && conf.KeyFile != "" {
+			err = ws.server.ListenAndServeTLS(conf.CertFile, conf.KeyFile)
+		} else {
+			err = ws.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+
+	log.Printf("Webhook listening on %s%s\n", conf.Listen, conf.Path)
+	return
+}
+
+// The bundled library does not know about secret_token yet,
+// so call setWebhook by hand.
+func (ws *webhookServer) register(api *tgbotapi.BotAPI) (err error) {
+	params := map[string]string{
+		"url":          ws.conf.URL,
+		"secret_token": ws.conf.SecretToken,
+	}
+	if ws.conf.MaxConnections != 0 {
+		params["max_connections"] = strconv.Itoa(ws.conf.MaxConnections)
+	}
+	if ws.conf.SelfSigned {
+		_, err = api.UploadFile("setWebhook", params, "certificate", ws.conf.CertFile)
+		return
+	}
+	v := url.Values{}
+	for key, value := range params {
+		v.Set(key, value)
+	}
+	_, err = api.MakeRequest("setWebhook", v)
+	return
+}
+
+func (ws *webhookServer) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.Header.Get(WEBHOOK_SECRET_HEADER)
+	if ws.conf.SecretToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(ws.conf.SecretToken)) != 1 {
+		log.Printf("Webhook: rejected request from %s with wrong secret token\n", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	var update tgbotapi.Update
+	err := json.NewDecoder(io.LimitReader(r.Body, WEBHOOK_MAX_BODY)).Decode(&update)
+	if err != nil {
+		log.Printf("Webhook: invalid update from %s: %v\n", r.RemoteAddr, err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ws.updates <- update
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ws *webhookServer) Shutdown(ctx context.Context) error {
+	return ws.server.Shutdown(ctx)
+}
+
+func (ws *webhookServer) Updates() <-chan tgbotapi.Update {
+	return ws.updates
+}
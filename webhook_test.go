@@ -0,0 +1,74 @@
+/*
+	Telegram WorldTreeBot
+	Copyright (C) 2017 StarBrilliant <m13253@hotmail.com>
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestWebhookConfigRequiresSecretToken(t *testing.T) {
+	conf := &WebhookConfig{
+		URL:    "https://bot.example.com/worldtree/update",
+		Listen: "127.0.0.1:8080",
+	}
+	if err := conf.Validate(); err == nil {
+		t.Fatal("webhook without secret_token accepted")
+	}
+	conf.SecretToken = "s3cret_token-1"
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookChecksSecretToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		status int
+	}{
+		{"right token", "s3cret", "s3cret", http.StatusOK},
+		{"no token", "s3cret", "", http.StatusForbidden},
+		{"wrong token", "s3cret", "s3cres", http.StatusForbidden},
+		{"token not configured", "", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		ws := &webhookServer{
+			conf:    &WebhookConfig{SecretToken: test.secret},
+			updates: make(chan tgbotapi.Update, 1),
+		}
+		r := httptest.NewRequest(http.MethodPost, "/update", strings.NewReader(`{"update_id": 1}`))
+		if test.header != "" {
+			r.Header.Set(WEBHOOK_SECRET_HEADER, test.header)
+		}
+		w := httptest.NewRecorder()
+		ws.handleUpdate(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, expected %d", test.name, w.Code, test.status)
+		}
+		if got := len(ws.updates); (got != 0) != (test.status == http.StatusOK) {
+			t.Errorf("%s: %d updates passed on", test.name, got)
+		}
+	}
+}